@@ -0,0 +1,410 @@
+package prombench
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ncabatoff/prombench/harness"
+	"github.com/ncabatoff/prombench/loadgen"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	AdaptiveSustainedSamples prometheus.Gauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "prombench",
+			Subsystem: "adaptive",
+			Name:      "sustained_samples_per_second",
+			Help:      "samples scraped per second at the highest load level Prometheus has sustained",
+		},
+	)
+
+	AdaptiveTargets prometheus.Gauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "prombench",
+			Subsystem: "adaptive",
+			Name:      "targets",
+			Help:      "number of load targets running at the load level being tried",
+		},
+	)
+
+	AdaptiveSignalTrips *prometheus.CounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prombench",
+			Subsystem: "adaptive",
+			Name:      "signal_trips_total",
+			Help:      "times each health signal showed Prometheus to be overloaded",
+		},
+		[]string{"signal"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(AdaptiveSustainedSamples)
+	prometheus.MustRegister(AdaptiveTargets)
+	prometheus.MustRegister(AdaptiveSignalTrips)
+}
+
+type (
+	// AdaptiveResult is the outcome of the search for the most load
+	// Prometheus can sustain.
+	AdaptiveResult struct {
+		// Converged is whether the search narrowed down to a single level
+		// before the run ended.
+		Converged bool `json:"converged"`
+		// SustainedTargets and SustainedSamplesPerSecond describe the highest
+		// load level sustained for the stability window, and are zero if
+		// even the initial load overloaded Prometheus.
+		SustainedTargets          int     `json:"sustained_targets"`
+		SustainedSamplesPerSecond float64 `json:"sustained_samples_per_second"`
+		// OverloadedTargets is the fewest targets found to overload
+		// Prometheus, or zero if none did.
+		OverloadedTargets int `json:"overloaded_targets"`
+		// RemovedTargets is how many targets were removed backing off.
+		RemovedTargets int             `json:"removed_targets"`
+		Levels         []AdaptiveLevel `json:"levels"`
+	}
+
+	// AdaptiveLevel is one load level tried by the search.
+	AdaptiveLevel struct {
+		Targets   int       `json:"targets"`
+		Start     time.Time `json:"start"`
+		End       time.Time `json:"end"`
+		Sustained bool      `json:"sustained"`
+		// Tripped names the health signals that showed the level overloaded
+		// Prometheus.
+		Tripped []string `json:"tripped,omitempty"`
+		// SamplesPerSecond is the rate samples were scraped at, excluding
+		// the first AdaptiveInterval after the level was reached.
+		SamplesPerSecond float64 `json:"samples_per_second"`
+	}
+
+	// HealthSignal is a PromQL expression that shows Prometheus to be
+	// overloaded when any element of its result exceeds Threshold.  An empty
+	// result says nothing either way.
+	HealthSignal struct {
+		Name      string
+		Query     string
+		Threshold float64
+	}
+	HealthSignalList []HealthSignal
+
+	// adaptiveSearch looks for the largest load Prometheus sustains.  Load is
+	// added and removed in steps of the targets described by cfg.Exporters on
+	// top of the initial load; the level is the number of steps running.
+	// Levels are doubled until one overloads Prometheus, then bisected
+	// between the highest sustained level and the lowest overloaded one.
+	adaptiveSearch struct {
+		cfg     Config
+		le      loadgen.LoadExporter
+		client  promClient
+		signals HealthSignalList
+		// noData holds the signals whose empty results have been logged.
+		noData map[string]bool
+		// initialTargets is the number of targets of the initial load,
+		// perStep the number in each step, and nextPort the port of the
+		// next target added.  steps holds the first port of each step.
+		initialTargets int
+		perStep        int
+		nextPort       int
+		steps          []int
+		// sustained is the highest level sustained and overloaded the lowest
+		// level that overloaded Prometheus, each -1 until there is one.
+		sustained  int
+		overloaded int
+		// levelStart is when the current level was reached, and
+		// windowStart when its stability window began, or zero while it's
+		// settling.
+		levelStart  time.Time
+		windowStart time.Time
+		result      AdaptiveResult
+	}
+)
+
+func (hs *HealthSignal) String() string {
+	return fmt.Sprintf("%s:%s:%s", hs.Name, formatValue(hs.Threshold), hs.Query)
+}
+
+func (hs *HealthSignal) Get() interface{} {
+	return *hs
+}
+
+// Set parses a signal given as name:threshold:query.
+func (hs *HealthSignal) Set(v string) error {
+	pieces := strings.SplitN(v, ":", 3)
+	if len(pieces) != 3 || pieces[0] == "" || strings.TrimSpace(pieces[2]) == "" {
+		return fmt.Errorf("bad health signal '%s': must be name:threshold:query", v)
+	}
+	threshold, err := strconv.ParseFloat(pieces[1], 64)
+	if err != nil {
+		return fmt.Errorf("invalid threshold in health signal '%s': %v", v, err)
+	}
+	*hs = HealthSignal{Name: pieces[0], Query: pieces[2], Threshold: threshold}
+	return nil
+}
+
+func (hsl *HealthSignalList) String() string {
+	ss := make([]string, len(*hsl))
+	for i, hs := range *hsl {
+		ss[i] = hs.String()
+	}
+	return strings.Join(ss, " ")
+}
+
+func (hsl *HealthSignalList) Get() interface{} {
+	return *hsl
+}
+
+// Set adds a signal to the list.  Queries may contain commas, so unlike other
+// lists each signal is given separately.
+func (hsl *HealthSignalList) Set(v string) error {
+	var hs HealthSignal
+	if err := hs.Set(v); err != nil {
+		return err
+	}
+	*hsl = append(*hsl, hs)
+	return nil
+}
+
+// defaultHealthSignals returns the signals used when none are configured:
+// whether scrapes of the load targets are falling behind their interval, or
+// taking long enough to risk timing out.  Prometheus 1.x lacks timestamp(), so
+// its own record of scrape intervals is used instead.
+func defaultHealthSignals(cfg Config, version harness.PrometheusVersion) HealthSignalList {
+	interval := cfg.ScrapeInterval.Seconds()
+	if version.Major == 1 {
+		return HealthSignalList{{
+			Name:      "scrape_interval_p99",
+			Query:     fmt.Sprintf(`prometheus_target_interval_length_seconds{quantile="0.99", interval="%s"}`, cfg.ScrapeInterval),
+			Threshold: 1.05 * interval,
+		}}
+	}
+	// Prometheus caps the default 10s scrape timeout at the scrape interval.
+	timeout := math.Min(interval, 10)
+	return HealthSignalList{
+		{
+			Name:      "scrape_lag",
+			Query:     `max(time() - timestamp(up{job!~"prometheus|prombench"}))`,
+			Threshold: 1.5 * interval,
+		},
+		{
+			Name:      "scrape_duration",
+			Query:     `max(scrape_duration_seconds{job!~"prometheus|prombench"})`,
+			Threshold: 0.8 * timeout,
+		},
+	}
+}
+
+// startAdaptive starts searching for the largest load put sustains by adding
+// targets to le on ports from firstPort, and removing them again to back off.
+// It returns a function that stops the search and returns its result.
+func startAdaptive(ctx context.Context, put *promUnderTest, le loadgen.LoadExporter, firstPort, initialTargets int) func() AdaptiveResult {
+	cfg := put.cfg
+	signals := cfg.HealthSignals
+	if len(signals) == 0 {
+		signals = defaultHealthSignals(cfg, put.version)
+	}
+	log.Printf("adaptive: overload signals: %s", signals.String())
+	as := &adaptiveSearch{
+		cfg:            cfg,
+		le:             le,
+		client:         put.client,
+		signals:        signals,
+		noData:         make(map[string]bool),
+		initialTargets: initialTargets,
+		nextPort:       firstPort,
+		sustained:      -1,
+		overloaded:     -1,
+		levelStart:     time.Now(),
+	}
+	for _, es := range cfg.Exporters {
+		as.perStep += es.Count
+	}
+	AdaptiveTargets.Set(float64(initialTargets))
+
+	myctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(cfg.AdaptiveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-myctx.Done():
+				return
+			case <-ticker.C:
+				if as.tick(myctx) {
+					return
+				}
+			}
+		}
+	}()
+	return func() AdaptiveResult {
+		cancel()
+		<-done
+		return as.result
+	}
+}
+
+// targets returns the number of targets running at level.
+func (as *adaptiveSearch) targets(level int) int {
+	return as.initialTargets + level*as.perStep
+}
+
+// checkSignals returns the names of the health signals showing Prometheus to
+// be overloaded, and false if no signal said anything either way.
+func (as *adaptiveSearch) checkSignals(ctx context.Context) (tripped []string, ok bool) {
+	for _, hs := range as.signals {
+		vect := queryPrometheusVector(ctx, as.client, hs.Query)
+		if len(vect) == 0 {
+			if !as.noData[hs.Name] {
+				log.Printf("adaptive: signal %s returned no data, ignoring it until it does", hs.Name)
+				as.noData[hs.Name] = true
+			}
+			continue
+		}
+		ok = true
+		worst := math.Inf(-1)
+		for _, sample := range vect {
+			worst = math.Max(worst, float64(sample.Value))
+		}
+		if worst > hs.Threshold {
+			log.Printf("adaptive: signal %s tripped: %s > %s", hs.Name, formatValue(worst), formatValue(hs.Threshold))
+			AdaptiveSignalTrips.WithLabelValues(hs.Name).Inc()
+			tripped = append(tripped, hs.Name)
+		}
+	}
+	return tripped, ok
+}
+
+// tick checks the current level, moving on to the next once it's known to
+// be sustained or overloaded.  It returns true when the search is over.
+func (as *adaptiveSearch) tick(ctx context.Context) bool {
+	now := time.Now()
+	// Give Prometheus one interval to catch up with a change of level.
+	if as.windowStart.IsZero() {
+		as.windowStart = now
+		return false
+	}
+	tripped, ok := as.checkSignals(ctx)
+	if !ok {
+		return false
+	}
+	level := len(as.steps)
+	switch {
+	case len(tripped) > 0:
+		as.endLevel(now, tripped)
+		as.overloaded = level
+		as.result.OverloadedTargets = as.targets(level)
+	case now.Sub(as.windowStart) >= as.cfg.AdaptiveStability:
+		rate := as.endLevel(now, nil)
+		as.sustained = level
+		as.result.SustainedTargets = as.targets(level)
+		as.result.SustainedSamplesPerSecond = rate
+		AdaptiveSustainedSamples.Set(rate)
+	default:
+		return false
+	}
+	return as.next()
+}
+
+// endLevel records the outcome of trying the current level, which was
+// sustained unless signals tripped, returning the rate samples were scraped
+// at during its stability window.
+func (as *adaptiveSearch) endLevel(now time.Time, tripped []string) float64 {
+	sustained := len(tripped) == 0
+	_, samples := as.le.Scrapes().Scraper(as.cfg.prometheusName).Window("", as.windowStart, now)
+	rate := float64(samples) / now.Sub(as.windowStart).Seconds()
+	targets := as.targets(len(as.steps))
+	as.result.Levels = append(as.result.Levels, AdaptiveLevel{
+		Targets:          targets,
+		Start:            as.levelStart,
+		End:              now,
+		Sustained:        sustained,
+		Tripped:          tripped,
+		SamplesPerSecond: rate,
+	})
+	if sustained {
+		log.Printf("adaptive: sustained %d targets, %.0f samples/second", targets, rate)
+	} else {
+		log.Printf("adaptive: %d targets overloaded Prometheus (%s)", targets, strings.Join(tripped, ", "))
+	}
+	return rate
+}
+
+// next moves to the next level to try, returning true if there's none, in
+// which case it settles on the highest level sustained.
+func (as *adaptiveSearch) next() bool {
+	var level int
+	switch {
+	case as.overloaded < 0:
+		level = 2 * as.sustained
+		if level < 1 {
+			level = 1
+		}
+	case as.overloaded-as.sustained > 1:
+		level = (as.sustained + as.overloaded) / 2
+	default:
+		as.result.Converged = true
+		level = as.sustained
+		if level < 0 {
+			level = 0
+		}
+		if err := as.setLevel(level); err != nil {
+			log.Printf("adaptive: unable to settle on %d targets: %v", as.targets(level), err)
+		}
+		return true
+	}
+	if err := as.setLevel(level); err != nil {
+		log.Printf("adaptive: stopping search: %v", err)
+		return true
+	}
+	return false
+}
+
+// setLevel adds or removes steps until level are running.
+func (as *adaptiveSearch) setLevel(level int) error {
+	for len(as.steps) < level {
+		as.steps = append(as.steps, as.nextPort)
+		started, err := startExporters(as.le, as.cfg.Exporters, as.nextPort)
+		as.nextPort += started
+		if err != nil {
+			return err
+		}
+	}
+	for len(as.steps) > level {
+		removed, err := stopExporters(as.le, as.cfg.Exporters, as.steps[len(as.steps)-1])
+		as.result.RemovedTargets += removed
+		if err != nil {
+			return err
+		}
+		as.steps = as.steps[:len(as.steps)-1]
+	}
+	as.levelStart, as.windowStart = time.Now(), time.Time{}
+	AdaptiveTargets.Set(float64(as.targets(level)))
+	log.Printf("adaptive: trying %d targets", as.targets(level))
+	return nil
+}
+
+// reportAdaptive logs the outcome of the search.
+func reportAdaptive(r AdaptiveResult) {
+	status := "search converged"
+	if !r.Converged {
+		status = "search incomplete"
+	}
+	switch {
+	case r.SustainedTargets == 0 && r.OverloadedTargets > 0:
+		log.Printf("adaptive: %s, the initial load overloaded Prometheus", status)
+		return
+	case r.SustainedTargets == 0:
+		log.Printf("adaptive: %s, no load level lasted the stability window", status)
+		return
+	}
+	log.Printf("adaptive: %s, maximum sustainable load %.0f samples/second from %d targets",
+		status, r.SustainedSamplesPerSecond, r.SustainedTargets)
+}
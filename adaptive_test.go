@@ -0,0 +1,190 @@
+package prombench
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/prometheus/client_golang/api/prometheus"
+)
+
+// fakeSignal is a Prometheus whose every query returns value as a single
+// element vector, or an empty vector if noData is set.
+type fakeSignal struct {
+	mtx    sync.Mutex
+	value  float64
+	noData bool
+}
+
+func (fs *fakeSignal) set(value float64, noData bool) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	fs.value, fs.noData = value, noData
+}
+
+func (fs *fakeSignal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	result := "[]"
+	if !fs.noData {
+		result = fmt.Sprintf(`[{"metric": {}, "value": [%d, "%g"]}]`, time.Now().Unix(), fs.value)
+	}
+	fmt.Fprintf(w, `{"status": "success", "data": {"resultType": "vector", "result": %s}}`, result)
+}
+
+// newTestAdaptive returns a search adding inc:2 steps to 10 initial targets on
+// fle from port 1000, judged by a signal tripping when fs exceeds threshold.
+func newTestAdaptive(t *testing.T, fle *fakeLoadExporter, fs *fakeSignal, threshold float64, stability time.Duration) (*adaptiveSearch, func()) {
+	server := httptest.NewServer(fs)
+	cfg := Config{
+		Exporters:         mustExporterSpecList(t, "inc:2"),
+		AdaptiveStability: stability,
+	}
+	as := &adaptiveSearch{
+		cfg:            cfg,
+		le:             fle,
+		client:         promClient{url: server.URL, transport: api.DefaultTransport},
+		signals:        HealthSignalList{{Name: "load", Query: "load", Threshold: threshold}},
+		noData:         make(map[string]bool),
+		initialTargets: 10,
+		perStep:        2,
+		nextPort:       1000,
+		sustained:      -1,
+		overloaded:     -1,
+		levelStart:     time.Now(),
+	}
+	return as, server.Close
+}
+
+func TestAdaptiveSearchConverges(t *testing.T) {
+	tests := []struct {
+		// tipping is the fewest targets that overload Prometheus.
+		tipping           int
+		levels            []int
+		sustained         []bool
+		sustainedTargets  int
+		overloadedTargets int
+		removedTargets    int
+	}{
+		// Doubling overshoots to 18 targets, then bisecting backs off to 16.
+		{17, []int{10, 12, 14, 18, 16}, []bool{true, true, true, false, true}, 16, 18, 2},
+		{19, []int{10, 12, 14, 18, 26, 22, 20}, []bool{true, true, true, true, false, false, false}, 18, 20, 8},
+		// Overloading with the first step backs off to the initial load.
+		{12, []int{10, 12}, []bool{true, false}, 10, 12, 2},
+		// Overloading with the initial load leaves nothing sustained.
+		{10, []int{10}, []bool{false}, 0, 10, 0},
+	}
+	for _, tt := range tests {
+		fle := &fakeLoadExporter{}
+		fs := &fakeSignal{}
+		as, stop := newTestAdaptive(t, fle, fs, float64(tt.tipping)-0.5, 0)
+		done := false
+		for i := 0; i < 100 && !done; i++ {
+			fs.set(float64(as.targets(len(as.steps))), false)
+			done = as.tick(context.Background())
+		}
+		stop()
+		if !done {
+			t.Errorf("tipping point %d: search didn't finish", tt.tipping)
+			continue
+		}
+
+		r := as.result
+		var levels []int
+		var sustained []bool
+		for _, l := range r.Levels {
+			levels = append(levels, l.Targets)
+			sustained = append(sustained, l.Sustained)
+		}
+		if !reflect.DeepEqual(levels, tt.levels) || !reflect.DeepEqual(sustained, tt.sustained) {
+			t.Errorf("tipping point %d: tried %v sustaining %v, want %v sustaining %v",
+				tt.tipping, levels, sustained, tt.levels, tt.sustained)
+		}
+		if !r.Converged || r.SustainedTargets != tt.sustainedTargets ||
+			r.OverloadedTargets != tt.overloadedTargets || r.RemovedTargets != tt.removedTargets {
+			t.Errorf("tipping point %d: result %+v, want converged sustaining %d, overloaded by %d, having removed %d",
+				tt.tipping, r, tt.sustainedTargets, tt.overloadedTargets, tt.removedTargets)
+		}
+
+		// The search settles on the highest level sustained, or the initial
+		// load if none was.
+		running := as.initialTargets
+		for _, op := range fle.ops {
+			if op[0] == '+' {
+				running++
+			} else {
+				running--
+			}
+		}
+		want := tt.sustainedTargets
+		if want == 0 {
+			want = as.initialTargets
+		}
+		if running != want {
+			t.Errorf("tipping point %d: search settled with %d targets running, want %d", tt.tipping, running, want)
+		}
+	}
+}
+
+func TestAdaptiveSearchBackOff(t *testing.T) {
+	fle := &fakeLoadExporter{}
+	fs := &fakeSignal{}
+	as, stop := newTestAdaptive(t, fle, fs, 11, 0)
+	defer stop()
+	for i := 0; i < 4; i++ {
+		fs.set(float64(as.targets(len(as.steps))), false)
+		if done := as.tick(context.Background()); done != (i == 3) {
+			t.Fatalf("tick %d returned %v", i, done)
+		}
+	}
+	// The step that tripped the signal is removed again.
+	if want := []string{"+1000", "+1001", "-1000", "-1001"}; !reflect.DeepEqual(fle.ops, want) {
+		t.Errorf("backing off did %v, want %v", fle.ops, want)
+	}
+	if got := as.result.Levels[1].Tripped; !reflect.DeepEqual(got, []string{"load"}) {
+		t.Errorf("overloaded level tripped %v, want [load]", got)
+	}
+}
+
+func TestAdaptiveSearchStability(t *testing.T) {
+	ctx := context.Background()
+	fle := &fakeLoadExporter{}
+	fs := &fakeSignal{}
+	as, stop := newTestAdaptive(t, fle, fs, 11, time.Hour)
+	defer stop()
+
+	steps := []struct {
+		value  float64
+		noData bool
+		done   bool
+		levels int
+	}{
+		// The first tick after a level is reached lets Prometheus settle,
+		// even if the signal has tripped.
+		{20, false, false, 0},
+		// A healthy level isn't sustained until the window has passed.
+		{10, false, false, 0},
+		{10, false, false, 0},
+		// A signal with no data says nothing either way.
+		{20, true, false, 0},
+		// A tripped signal ends the level without waiting out the window.
+		{20, false, true, 1},
+	}
+	for i, step := range steps {
+		fs.set(step.value, step.noData)
+		if done := as.tick(ctx); done != step.done {
+			t.Errorf("step %d: tick() = %v, want %v", i, done, step.done)
+		}
+		if got := len(as.result.Levels); got != step.levels {
+			t.Errorf("step %d: %d levels ended, want %d", i, got, step.levels)
+		}
+	}
+	if len(fle.ops) != 0 {
+		t.Errorf("search changed targets without sustaining a level: %v", fle.ops)
+	}
+}
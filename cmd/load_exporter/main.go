@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -8,43 +10,135 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 
+	"github.com/ncabatoff/prombench"
 	"github.com/ncabatoff/prombench/loadgen"
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nServes load exporter targets, one per port starting at -first-port.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		flag.PrintDefaults()
+	}
 	var (
-		listenAddress = flag.String("web.listen-address", ":10000",
-			"Address on which to expose metrics.")
-		metricsPath = flag.String("web.telemetry-path", "/metrics",
-			"Path under which to expose metrics.")
-		metricCount = flag.Int("metric-count", 100,
-			"how many metrics to expose per exporter")
-		labelCount = flag.Int("label-count", 100,
-			"how many labels to create per metric")
+		listenAddress = flag.String("web.listen-address", ":9998",
+			"Address on which to expose load_exporter's own metrics and expected sums.")
+		firstPort = flag.Int("first-port", 10000,
+			"First port to assign to load exporters.")
+		targetHost = flag.String("target-host", "localhost",
+			"Host load exporters listen on and are identified by in sd_config files.")
+		sdConfigDir = flag.String("sd-config-dir", "",
+			"if set, directory in which to write a file_sd_configs file for each load exporter")
+		multiplex = new(loadgen.MultiplexMode)
+		exporters = &prombench.ExporterSpecList{prombench.ExporterSpec{Exporter: prombench.ExporterInc, Count: 1}}
+		control   = flag.Bool("control", false,
+			"serve targets as directed by control requests read from stdin, writing responses to stdout; used by prombench")
 	)
+	flag.Var(exporters, "exporters", "Comma-separated list of exporter:count[:key=value,...], as accepted by prombench")
+	flag.Var(multiplex, "multiplex", "Serve all exporters from one listener on -first-port, distinguished by metrics path (path) or by loopback address (loopback, Linux only), rather than one port each (none)")
 	flag.Parse()
 
-	tc := loadgen.NewIncCollector(*metricCount, *labelCount)
-	prometheus.MustRegister(tc)
+	newExporter := func(spec string) (loadgen.Exporter, error) {
+		var es prombench.ExporterSpec
+		if err := es.Set(spec); err != nil {
+			return nil, err
+		}
+		return prombench.NewExporter(es)
+	}
+
+	if *control {
+		le := loadgen.NewLoadExporterInternal(context.Background(), nil)
+		le.SetHost(*targetHost)
+		if err := loadgen.ServeControl(os.Stdin, os.Stdout, le, newExporter); err != nil {
+			log.Fatalf("Control channel failed: %v", err)
+		}
+		return
+	}
+
+	var discovery loadgen.Discovery
+	if *sdConfigDir != "" {
+		discovery = loadgen.NewFileDiscovery(*sdConfigDir)
+	}
+	le := loadgen.NewLoadExporterInternal(context.Background(), discovery)
+	le.SetHost(*targetHost)
+	if err := le.SetMultiplex(*multiplex, *firstPort); err != nil {
+		log.Fatalf("Error multiplexing exporters: %v", err)
+	}
+	port := *firstPort
+	for _, es := range *exporters {
+		for i := 0; i < es.Count; i++ {
+			exporter, err := prombench.NewExporter(es)
+			if err != nil {
+				log.Fatalf("Error creating exporter: %v", err)
+			}
+			if err := le.AddTarget(port, es.Exporter.String(), exporter); err != nil {
+				log.Fatalf("Error starting exporter: %v", err)
+			}
+			port++
+		}
+	}
+	log.Printf("serving %s on ports %d-%d", exporters.String(), *firstPort, port-1)
+
 	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, syscall.SIGTERM)
+	signal.Notify(sigchan, syscall.SIGTERM, os.Interrupt)
 	go func() {
 		<-sigchan
-		fmt.Printf("%d", tc.Sum())
+		sums, err := le.Stop()
+		if err != nil {
+			log.Fatalf("Error stopping exporters: %v", err)
+		}
+		log.Printf("stopped %d exporters", len(sums))
 		os.Exit(0)
 	}()
 
-	http.Handle(*metricsPath, prometheus.Handler())
-
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/sums", func(w http.ResponseWriter, r *http.Request) {
+		sums, err := le.Sums()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Ledgers hold every series, so only include them on request.
+		if r.URL.Query().Get("ledger") == "" {
+			for i := range sums {
+				sums[i].Ledger = nil
+			}
+		}
+		writeJSON(w, sums)
+	})
+	http.HandleFunc("/scrapes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, le.Scrapes())
+	})
+	http.HandleFunc("/remove", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "removing an exporter requires POST", http.StatusMethodNotAllowed)
+			return
+		}
+		port, err := strconv.Atoi(r.URL.Query().Get("port"))
+		if err != nil {
+			http.Error(w, "port must be a number", http.StatusBadRequest)
+			return
+		}
+		if err := le.RemoveTarget(port); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Printf("removed exporter on port %d", port)
+	})
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
-			<head><title>test exporter</title></head>
+			<head><title>load exporter</title></head>
 			<body>
-			<h1>test exporter</h1>
-			<p><a href="` + *metricsPath + `">Metrics</a></p>
+			<h1>load exporter</h1>
+			<p><a href="/metrics">Metrics</a></p>
+			<p><a href="/sums">Expected sums</a> (<a href="/sums?ledger=1">with per-series ledgers</a>)</p>
+			<p><a href="/scrapes">Scrapes served</a></p>
 			</body>
 			</html>`))
 	})
@@ -52,3 +146,10 @@ func main() {
 		log.Fatalf("Unable to setup HTTP server: %v", err)
 	}
 }
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error writing response: %v", err)
+	}
+}
@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/ncabatoff/prombench"
+	"github.com/ncabatoff/prombench/harness"
+	"github.com/ncabatoff/prombench/loadgen"
 	"github.com/prometheus/client_golang/prometheus"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -24,62 +31,206 @@ func main() {
 	var (
 		firstPort = flag.Int("first-port", 10000,
 			"First port to assign to load exporters.")
-		exporters = &prombench.ExporterSpecList{prombench.ExporterSpec{prombench.ExporterInc, 3}}
+		exporters = &prombench.ExporterSpecList{prombench.ExporterSpec{Exporter: prombench.ExporterInc, Count: 3}}
 		rmtestdir = flag.Bool("rmtestdir", false,
 			"delete the test dir if present")
 		scrapeInterval = flag.Duration("scrape-interval", time.Second,
 			"scrape interval")
 		adaptiveInterval = flag.Duration("adaptive-interval", 0,
-			"if nonzero, interval at which to try adding new exporters if not yet too loaded")
+			"if nonzero, interval at which to check whether Prometheus is overloaded while searching for the largest load it sustains")
+		adaptiveStability = flag.Duration("adaptive-stability", time.Minute,
+			"how long a load level must go without overloading Prometheus to count as sustained")
+		resourceInterval = flag.Duration("resource-interval", time.Second,
+			"if nonzero, interval at which to sample Prometheus's resource usage from /proc into resources.csv")
+		storageInterval = flag.Duration("storage-interval", 10*time.Second,
+			"if nonzero, interval at which to measure the size of Prometheus's data directory")
+		crashAfter = flag.Duration("crash-after", 0,
+			"if nonzero, how long into the test to SIGKILL Prometheus and restart it, to measure crash recovery")
+		checkInterval = flag.Duration("check-interval", 0,
+			"if nonzero, interval at which to verify the most recent window of samples while the test runs")
 		testDirectory = flag.String("test-directory", "prombench-data",
 			"directory in which all writes will take place")
 		testDuration = flag.Duration("test-duration", time.Minute,
 			"test duration")
 		testRetention = flag.Duration("test-retention", 5*time.Minute,
-			"retention period: will be passed to Prometheus as storage.local.retention")
+			"retention period: will be passed to Prometheus as storage.local.retention before 2.0, "+
+				"storage.tsdb.retention before 2.8, and storage.tsdb.retention.time since")
 		maxDeltaRatio = flag.Float64("max-delta-ratio", 0.15,
 			"absolute deviation from expected value tolerated without query retry [0-1]")
 		maxQueryRetries = flag.Int("max-query-retries", 0,
 			"how many query retries to do until maxDeltaRatio is satisfied")
 		benchListenAddress = flag.String("web.listen-address", ":9999",
 			"Address on which to expose prombench metrics.")
+		httpSdListenAddress = flag.String("http-sd.listen-address", ":9997",
+			"address to serve exporters at /sd for http_sd_configs on, with -discovery http")
 		promListenAddress = flag.String("prometheus.listen-address", ":8989",
 			"Address on which the Prometheus being tested exposes metrics and serves queries.")
-		runIntervals = &prombench.RunIntervalSpecList{}
+		comparePath = flag.String("compare.prometheus-path", "",
+			"if set, path of a second Prometheus binary to run alongside the first, scraping the same exporters, and compare against it")
+		compareListenAddress = flag.String("compare.prometheus.listen-address", ":8990",
+			"Address on which the Prometheus given by -compare.prometheus-path exposes metrics and serves queries.")
+		runIntervals     = &prombench.RunIntervalSpecList{}
+		loadExporterPath = flag.String("load-exporter-path", "",
+			"if set, path of the load_exporter binary used to serve exporters out of process")
+		configTemplate = flag.String("prometheus.config-template", "",
+			"if set, path of a Go template for prometheus.yml, which must keep the 'test' job; see the README")
+		externalURL = flag.String("external-prometheus.url", "",
+			"if set, URL of an externally managed Prometheus to benchmark instead of starting one; it must discover the exporters itself")
+		sdConfigDir = flag.String("sd-config-dir", "",
+			"with -external-prometheus.url and -discovery file, directory in which to write a file_sd_configs file for each exporter")
+		targetHost = flag.String("target-host", "",
+			"host exporters listen on and are registered as for discovery, by default localhost")
+		promUsername = flag.String("prometheus.username", "",
+			"if set, username for basic auth when querying Prometheus")
+		promPasswordFile = flag.String("prometheus.password-file", "",
+			"file containing the password for basic auth when querying Prometheus")
+		promBearerTokenFile = flag.String("prometheus.bearer-token-file", "",
+			"if set, file containing a bearer token to send when querying Prometheus")
+		reloads             = &prombench.ReloadSpecList{}
+		reloadMethod        = new(harness.ReloadMethod)
+		healthSignals       = &prombench.HealthSignalList{}
+		multiplex           = new(loadgen.MultiplexMode)
+		discovery           = new(loadgen.DiscoveryMode)
+		loadExporterWorkers = flag.Int("load-exporter-workers", 0,
+			"maximum number of load_exporter processes to spread exporters over, or 0 for one per exporter")
+		queries          = &prombench.QuerySpecList{}
+		queryConcurrency = flag.Int("query-concurrency", 4,
+			"number of workers issuing the queries given by -query")
+		queryRate = flag.Float64("query-rate", 0,
+			"if nonzero, maximum rate in queries per second at which -query queries are issued, across all workers")
+		scenarioFile = flag.String("scenario", "",
+			"if set, JSON file giving flag values, the Prometheus to run and a sequence of load phases; flags given on the command line take precedence")
 	)
-	flag.Var(exporters, "exporters", "Comma-separated list of exporter:count, where exporter is one of: inc, static, randcyclic, oscillate")
+	flag.Var(exporters, "exporters", "Comma-separated list of exporter:count[:key=value,...], where exporter is one of: inc, static, randcyclic, oscillate, counter, histogram, summary, churn; "+
+		"options are metrics=N, labels=N, (randcyclic only) max=N, (counter only) reset=N, "+
+		"(histogram and summary only) dist=uniform|exp|normal and obs=N, (histogram only) buckets=B1;B2;..., "+
+		"and (churn only) fraction=F and every=N")
+	flag.Var(discovery, "discovery", "How Prometheus discovers exporters: file_sd_configs files (file), a static_configs block reloaded as exporters are added (static), or http_sd_configs served by prombench at /sd on -http-sd.listen-address (http)")
+	flag.Var(multiplex, "multiplex", "Serve all exporters from one listener on -first-port, distinguished by metrics path (path) or by loopback address (loopback, Linux only), rather than one port each (none)")
+	flag.Var(reloads, "reload", "Comma-separated list of after[:change], rewrite prometheus.yml and reload Prometheus after the given duration into the test; "+
+		"change is scrape-interval=duration to change the test job's scrape interval, or relabel to add a metric relabel rule")
+	flag.Var(reloadMethod, "reload-method", "How to reload Prometheus: sighup, or http to post to /-/reload")
 	flag.Var(runIntervals, "run-every", "Comma-separated list of interval:command, invoke command every interval duration")
+	flag.Var(healthSignals, "adaptive-signal", "name:threshold:query, a PromQL query showing Prometheus overloaded during the adaptive search when any result exceeds threshold; "+
+		"may be repeated, and replaces the default scrape lag and duration signals")
+	flag.Var(queries, "query", "name:range[/step]:query, a PromQL query to issue repeatedly while the load runs, reporting its latency and errors; "+
+		"a range of 0 makes it an instant query, otherwise it's a range query ending now with the given step, by default range/250; may be repeated")
 	flag.Parse()
 
 	extraArgs := flag.Args()
+	var phases []prombench.PhaseSpec
+	if *scenarioFile != "" {
+		scenario, err := prombench.LoadScenario(*scenarioFile)
+		if err != nil {
+			log.Fatalf("error loading scenario: %v", err)
+		}
+		given := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+		for name, value := range scenario.Flags {
+			if given[name] {
+				continue
+			}
+			if err := flag.Set(name, value); err != nil {
+				log.Fatalf("bad value %q for flag -%s in scenario: %v", value, name, err)
+			}
+			given[name] = true
+		}
+		// Phases supply the load, so don't start the default exporters.
+		if len(scenario.Phases) > 0 && !given["exporters"] {
+			*exporters = nil
+		}
+		if len(extraArgs) == 0 {
+			extraArgs = scenario.Args
+		}
+		phases = scenario.Phases
+	}
 	promPath := "prometheus"
 	if len(extraArgs) > 0 {
 		promPath = extraArgs[0]
 		extraArgs = extraArgs[1:]
 	}
 
+	promPassword := readSecret(*promPasswordFile)
+	promBearerToken := readSecret(*promBearerTokenFile)
+
 	http.Handle("/metrics", prometheus.Handler())
 	go http.ListenAndServe(*benchListenAddress, nil)
-	prombench.Run(prombench.Config{
-		FirstPort:               *firstPort,
-		Exporters:               *exporters,
-		TestDirectory:           *testDirectory,
-		RmTestDirectory:         *rmtestdir,
-		PrometheusPath:          promPath,
-		ScrapeInterval:          *scrapeInterval,
-		TestDuration:            *testDuration,
-		TestRetention:           *testRetention,
-		MaxDeltaRatio:           *maxDeltaRatio,
-		MaxQueryRetries:         *maxQueryRetries,
-		ExtraArgs:               extraArgs,
-		RunIntervals:            *runIntervals,
-		AdaptiveInterval:        *adaptiveInterval,
-		PrombenchListenAddress:  *benchListenAddress,
-		PrometheusListenAddress: *promListenAddress,
+	// Stop cleanly on an interrupt, leaving no exporters or Prometheus behind.
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("received %v, stopping", sig)
+		cancel()
+	}()
+
+	result, err := prombench.Run(ctx, prombench.Config{
+		FirstPort:                      *firstPort,
+		Exporters:                      *exporters,
+		TestDirectory:                  *testDirectory,
+		RmTestDirectory:                *rmtestdir,
+		PrometheusPath:                 promPath,
+		ScrapeInterval:                 *scrapeInterval,
+		TestDuration:                   *testDuration,
+		TestRetention:                  *testRetention,
+		MaxDeltaRatio:                  *maxDeltaRatio,
+		MaxQueryRetries:                *maxQueryRetries,
+		ExtraArgs:                      extraArgs,
+		RunIntervals:                   *runIntervals,
+		AdaptiveInterval:               *adaptiveInterval,
+		AdaptiveStability:              *adaptiveStability,
+		Reloads:                        *reloads,
+		HealthSignals:                  *healthSignals,
+		Phases:                         phases,
+		Queries:                        *queries,
+		QueryConcurrency:               *queryConcurrency,
+		QueryRate:                      *queryRate,
+		ReloadMethod:                   *reloadMethod,
+		ResourceInterval:               *resourceInterval,
+		StorageInterval:                *storageInterval,
+		CrashAfter:                     *crashAfter,
+		CheckInterval:                  *checkInterval,
+		LoadExporterPath:               *loadExporterPath,
+		LoadExporterWorkers:            *loadExporterWorkers,
+		Multiplex:                      *multiplex,
+		Discovery:                      *discovery,
+		PrometheusConfigTemplate:       *configTemplate,
+		ExternalPrometheusURL:          *externalURL,
+		SdConfigDir:                    *sdConfigDir,
+		TargetHost:                     *targetHost,
+		PrometheusUsername:             *promUsername,
+		PrometheusPassword:             promPassword,
+		PrometheusBearerToken:          promBearerToken,
+		PrombenchListenAddress:         *benchListenAddress,
+		PrometheusListenAddress:        *promListenAddress,
+		HTTPSdListenAddress:            *httpSdListenAddress,
+		ComparePrometheusPath:          *comparePath,
+		ComparePrometheusListenAddress: *compareListenAddress,
 	})
+	if err != nil {
+		log.Fatalf("prombench failed: %v", err)
+	}
 
 	writeMetrics(*benchListenAddress, *testDirectory)
 	time.Sleep(5 * time.Second)
+	if !result.Passed {
+		log.Printf("verification failed, see %s", filepath.Join(*testDirectory, "result.json"))
+		os.Exit(1)
+	}
+}
+
+// readSecret returns the contents of filename without surrounding whitespace,
+// or "" if filename is "".
+func readSecret(filename string) string {
+	if filename == "" {
+		return ""
+	}
+	secret, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Fatalf("error reading secret: %v", err)
+	}
+	return strings.TrimSpace(string(secret))
 }
 
 func writeMetrics(listenAddr, testdir string) {
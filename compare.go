@@ -0,0 +1,166 @@
+package prombench
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ncabatoff/prombench/loadgen"
+)
+
+// queryLatencyRuns is how many times the benchmark query is run to measure
+// query latency.
+const queryLatencyRuns = 5
+
+// PrometheusSummary is how one Prometheus fared over a run, as compared
+// between the Prometheus servers of an A/B run.
+type PrometheusSummary struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	// ScrapedSamples is the number of samples the load exporters served to
+	// this Prometheus, and StoredSamples how many of them it returns from
+	// queries; Completeness is their ratio.
+	ScrapedSamples int     `json:"scraped_samples"`
+	StoredSamples  int     `json:"stored_samples"`
+	Completeness   float64 `json:"completeness"`
+	// TotalDelta is the total difference between the expected and queried
+	// sums over all load instances.
+	TotalDelta int `json:"total_delta"`
+	// QueryLatencyMedian and QueryLatencyMax are of queryLatencyRuns runs of
+	// a sum over all load series for the whole run.
+	QueryLatencyMedian float64 `json:"query_latency_median_seconds"`
+	QueryLatencyMax    float64 `json:"query_latency_max_seconds"`
+	MaxRSSBytes        int     `json:"max_rss_bytes"`
+	CPUSeconds         float64 `json:"cpu_seconds"`
+	StorageBytes       int64   `json:"storage_bytes"`
+	// StorageBytesPerSample is StorageBytes divided by ScrapedSamples.
+	StorageBytesPerSample float64 `json:"storage_bytes_per_sample"`
+}
+
+// compareConfigs returns the Configs of the two Prometheus servers to compare:
+// "a" runs PrometheusPath and "b" ComparePrometheusPath, each in its own
+// subdirectory of the test directory.
+func compareConfigs(cfg Config) []Config {
+	a, b := cfg, cfg
+	a.prometheusName, b.prometheusName = "a", "b"
+	a.TestDirectory = filepath.Join(cfg.TestDirectory, a.prometheusName)
+	b.TestDirectory = filepath.Join(cfg.TestDirectory, b.prometheusName)
+	b.PrometheusPath = cfg.ComparePrometheusPath
+	b.PrometheusListenAddress = cfg.ComparePrometheusListenAddress
+	return []Config{a, b}
+}
+
+// runName is the run_name label of the queries made to the Prometheus cfg is
+// for in QueryTime.
+func (c Config) runName() string {
+	if c.prometheusName != "" {
+		return c.prometheusName
+	}
+	return "run1"
+}
+
+// storedSamples returns the number of samples scraped from all load instances
+// between startTime and end according to scrapes, and the number put has stored.
+func storedSamples(ctx context.Context, put *promUnderTest, startTime, end time.Time, scrapes loadgen.ScrapeLedger) (scraped, stored int) {
+	query, start := rangeQuery(`sum(count_over_time({__name__=~"test.+"}[%s]))`, startTime, end)
+	vect := queryPrometheusVectorAt(ctx, put.client, query, end)
+	if len(vect) > 0 {
+		stored = int(vect[0].Value)
+	}
+	return int(windowSamples(put.cfg, scrapes, "")(start, end)), stored
+}
+
+// measureQueryLatency runs a query summing all load series since startTime
+// queryLatencyRuns times, returning the median and maximum latency.
+func measureQueryLatency(ctx context.Context, put *promUnderTest, startTime time.Time) (median, max time.Duration) {
+	query, _ := rangeQuery(`sum(sum_over_time({__name__=~"test.+"}[%s]))`, startTime, time.Now())
+	latencies := make([]time.Duration, queryLatencyRuns)
+	for i := range latencies {
+		queryStart := time.Now()
+		queryPrometheusVector(ctx, put.client, query)
+		latencies[i] = time.Since(queryStart)
+		QueryTime.WithLabelValues(put.cfg.runName(), query).Observe(latencies[i].Seconds())
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies[len(latencies)/2], latencies[len(latencies)-1]
+}
+
+// summarize returns the PrometheusSummary of put, given the scrapes it made
+// and the resource and storage samples taken during the run.
+func summarize(ctx context.Context, put *promUnderTest, startTime time.Time, scrapes loadgen.ScrapeLedger,
+	resources []ResourceSample, storage map[string]int64) PrometheusSummary {
+	summary := PrometheusSummary{
+		Name:        put.cfg.prometheusName,
+		Path:        put.cfg.PrometheusPath,
+		MaxRSSBytes: maxRSS(resources),
+		CPUSeconds:  cpuUsed(resources),
+	}
+	if put.h != nil {
+		summary.Version = put.version.String()
+	}
+	summary.ScrapedSamples, summary.StoredSamples = storedSamples(ctx, put, startTime, time.Now(), scrapes)
+	if summary.ScrapedSamples > 0 {
+		summary.Completeness = float64(summary.StoredSamples) / float64(summary.ScrapedSamples)
+	}
+	median, max := measureQueryLatency(ctx, put, startTime)
+	summary.QueryLatencyMedian, summary.QueryLatencyMax = median.Seconds(), max.Seconds()
+	if storage != nil {
+		summary.StorageBytes = totalStorage(storage)
+		_, scraped := scrapes.Window("", time.Time{}, time.Now())
+		if scraped > 0 {
+			summary.StorageBytesPerSample = float64(summary.StorageBytes) / float64(scraped)
+		}
+	}
+	return summary
+}
+
+// reportComparison logs summaries side by side and writes them to
+// comparison.json in the test directory.
+func reportComparison(cfg Config, summaries []PrometheusSummary) {
+	rows := []struct {
+		name  string
+		value func(PrometheusSummary) string
+	}{
+		{"path", func(s PrometheusSummary) string { return s.Path }},
+		{"version", func(s PrometheusSummary) string { return s.Version }},
+		{"samples scraped", func(s PrometheusSummary) string { return fmt.Sprint(s.ScrapedSamples) }},
+		{"samples stored", func(s PrometheusSummary) string { return fmt.Sprint(s.StoredSamples) }},
+		{"completeness", func(s PrometheusSummary) string { return fmt.Sprintf("%.4f%%", 100*s.Completeness) }},
+		{"total delta", func(s PrometheusSummary) string { return fmt.Sprint(s.TotalDelta) }},
+		{"query latency median", func(s PrometheusSummary) string { return fmt.Sprintf("%.3fs", s.QueryLatencyMedian) }},
+		{"query latency max", func(s PrometheusSummary) string { return fmt.Sprintf("%.3fs", s.QueryLatencyMax) }},
+		{"max RSS bytes", func(s PrometheusSummary) string { return fmt.Sprint(s.MaxRSSBytes) }},
+		{"CPU seconds", func(s PrometheusSummary) string { return fmt.Sprintf("%.2f", s.CPUSeconds) }},
+		{"storage bytes", func(s PrometheusSummary) string { return fmt.Sprint(s.StorageBytes) }},
+		{"storage bytes per sample", func(s PrometheusSummary) string { return fmt.Sprintf("%.2f", s.StorageBytesPerSample) }},
+	}
+	header := fmt.Sprintf("%-26s", "comparison")
+	for _, s := range summaries {
+		header += fmt.Sprintf(" %-24s", s.Name)
+	}
+	log.Print(header)
+	for _, row := range rows {
+		line := fmt.Sprintf("%-26s", row.name)
+		for _, s := range summaries {
+			line += fmt.Sprintf(" %-24s", row.value(s))
+		}
+		log.Print(line)
+	}
+
+	filename := filepath.Join(cfg.TestDirectory, "comparison.json")
+	data, err := json.MarshalIndent(summaries, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(filename, data, 0600)
+	}
+	if err != nil {
+		log.Printf("error writing comparison to %q: %v", filename, err)
+		return
+	}
+	log.Printf("comparison written to %q", filename)
+}
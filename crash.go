@@ -0,0 +1,135 @@
+package prombench
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/ncabatoff/prombench/harness"
+	"github.com/ncabatoff/prombench/loadgen"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// recoveryTimeout is how long to wait for Prometheus to recover after a crash.
+const recoveryTimeout = 10 * time.Minute
+
+var (
+	CrashRecoveryTime prometheus.Gauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "prombench",
+			Subsystem: "crash",
+			Name:      "recovery_seconds",
+			Help:      "time from restarting Prometheus after a SIGKILL until it answered queries",
+		},
+	)
+
+	CrashGap prometheus.Gauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "prombench",
+			Subsystem: "crash",
+			Name:      "gap_seconds",
+			Help:      "longest time a target went unscraped around a SIGKILL of Prometheus",
+		},
+	)
+
+	CrashLostSamples prometheus.Gauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "prombench",
+			Subsystem: "crash",
+			Name:      "lost_samples",
+			Help:      "samples scraped before a SIGKILL of Prometheus that weren't there after it restarted",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(CrashRecoveryTime)
+	prometheus.MustRegister(CrashGap)
+	prometheus.MustRegister(CrashLostSamples)
+}
+
+// crashRecovery describes a SIGKILL of Prometheus and its restart.
+type crashRecovery struct {
+	// Killed is when Prometheus was killed, Restarted when it was started
+	// again, and Ready when it next answered queries, or zero if it didn't.
+	Killed, Restarted, Ready time.Time
+}
+
+// crashPrometheus kills Prometheus, restarts it on the same test directory
+// with the same arguments, and waits for it to answer readyQuery.  It returns
+// the function to stop the restarted Prometheus.
+func crashPrometheus(ctx context.Context, cfg Config, h *harness.Harness, promArgs []string, pc promClient, readyQuery string) (crashRecovery, context.CancelFunc, error) {
+	var cr crashRecovery
+	log.Printf("killing Prometheus")
+	if err := h.KillPrometheus(); err != nil {
+		return cr, nil, fmt.Errorf("crash test failed: %v", err)
+	}
+	cr.Killed = time.Now()
+
+	cr.Restarted = time.Now()
+	stop, err := h.StartPrometheus(ctx, cfg.PrometheusPath, promArgs)
+	if err != nil {
+		return cr, nil, fmt.Errorf("unable to restart Prometheus after crashing it: %v", err)
+	}
+	if waitForPrometheus(ctx, pc, readyQuery, recoveryTimeout) {
+		cr.Ready = time.Now()
+		recovery := cr.Ready.Sub(cr.Restarted)
+		CrashRecoveryTime.Set(recovery.Seconds())
+		log.Printf("Prometheus recovered %v after restarting, down for %v in all", recovery, cr.Ready.Sub(cr.Killed))
+	} else {
+		log.Printf("Prometheus didn't recover within %v of restarting", recoveryTimeout)
+	}
+	return cr, stop, nil
+}
+
+// windowSamples returns an expectation of the number of samples scraped from
+// instance during the query range, as recorded in scrapes.
+func windowSamples(cfg Config, scrapes loadgen.ScrapeLedger, instance string) expectation {
+	return func(start, end time.Time) float64 {
+		if cfg.TestRetention > 0 && end.Add(-cfg.TestRetention).After(start) {
+			start = end.Add(-cfg.TestRetention)
+		}
+		_, samples := scrapes.Window(instance, start, end)
+		return float64(samples)
+	}
+}
+
+// scrapeGap returns the longest time any instance went unscraped across t.
+func scrapeGap(scrapes loadgen.ScrapeLedger, t time.Time) time.Duration {
+	last := make(map[string]time.Time)
+	var gap time.Duration
+	for _, s := range scrapes {
+		if prev, ok := last[s.Instance]; ok && !prev.After(t) && s.Time.After(t) {
+			if d := s.Time.Sub(prev); d > gap {
+				gap = d
+			}
+		}
+		last[s.Instance] = s.Time
+	}
+	return gap
+}
+
+// verifyCrash checks that what was scraped before Prometheus was killed
+// survived its restart, and reports how long targets went unscraped.
+func verifyCrash(ctx context.Context, cfg Config, pc promClient, startTime time.Time, cr crashRecovery, scrapes loadgen.ScrapeLedger) CrashResult {
+	query := `sum(count_over_time({__name__=~"test.+"}[%s]))`
+	countCheck := verifyQueryAt(ctx, cfg, pc, startTime, cr.Killed, query, windowSamples(cfg, scrapes, ""), cfg.MaxDeltaRatio)
+	lost := math.Abs(float64(countCheck.Delta))
+	CrashLostSamples.Set(lost)
+	query = `sum(sum_over_time({__name__=~"test.+"}[%s]))`
+	sumCheck := verifyQueryAt(ctx, cfg, pc, startTime, cr.Killed, query, windowSum(cfg, scrapes, ""), cfg.MaxDeltaRatio)
+
+	gap := scrapeGap(scrapes, cr.Killed)
+	CrashGap.Set(gap.Seconds())
+	log.Printf("crash: %s samples scraped before the crash were lost, targets went unscraped for up to %v (%d scrape intervals)",
+		formatValue(lost), gap, int(gap/cfg.ScrapeInterval))
+
+	checks := []QueryCheck{countCheck, sumCheck}
+	result := CrashResult{LostSamples: lost, GapSeconds: gap.Seconds(), Checks: checks, Passed: passed(checks)}
+	if !cr.Ready.IsZero() {
+		result.RecoverySeconds = cr.Ready.Sub(cr.Restarted).Seconds()
+	}
+	return result
+}
@@ -0,0 +1,192 @@
+package prombench
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/facebookgo/httpdown"
+	"github.com/ncabatoff/prombench/harness"
+	"github.com/ncabatoff/prombench/loadgen"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// httpSdPath is where prombench serves targets for http_sd_configs.
+const httpSdPath = "/sd"
+
+var (
+	DiscoveryLatency *prometheus.HistogramVec = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "prombench",
+			Subsystem: "discovery",
+			Name:      "latency_seconds",
+			Help:      "time from registering a load target to its first scrape",
+			Buckets:   []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		},
+		[]string{"mechanism"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(DiscoveryLatency)
+}
+
+// timedDiscovery records when each target is registered, keyed by instance.
+type timedDiscovery struct {
+	loadgen.Discovery
+	mtx        sync.Mutex
+	registered map[string]time.Time
+}
+
+func (td *timedDiscovery) Register(id int, addr string, labels map[string]string) error {
+	instance := labels[model.InstanceLabel]
+	if instance == "" {
+		instance = addr
+	}
+	td.mtx.Lock()
+	td.registered[instance] = time.Now()
+	td.mtx.Unlock()
+	return td.Discovery.Register(id, addr, labels)
+}
+
+// PrombenchInstance returns the address at which Prometheus can reach prombench.
+func (c Config) PrombenchInstance() (string, error) {
+	return listenInstance(c.PrombenchListenAddress)
+}
+
+// HTTPSdInstance returns the address at which Prometheus can reach the
+// targets served for http_sd_configs.
+func (c Config) HTTPSdInstance() (string, error) {
+	return listenInstance(c.HTTPSdListenAddress)
+}
+
+// testSdConfig returns the discovery config Prometheus should start with for
+// the test job.
+func testSdConfig(cfg Config) (string, error) {
+	switch cfg.Discovery {
+	case loadgen.DiscoveryFile:
+		return harness.FileSdConfig(), nil
+	case loadgen.DiscoveryStatic:
+		return harness.StaticSdConfig(nil)
+	case loadgen.DiscoveryHTTP:
+		instance, err := cfg.HTTPSdInstance()
+		if err != nil {
+			return "", err
+		}
+		return harness.HTTPSdConfig("http://" + instance + httpSdPath), nil
+	}
+	return "", fmt.Errorf("unsupported discovery mode %v", cfg.Discovery)
+}
+
+// serveHTTPSd serves hd at httpSdPath on listenAddress until the function
+// returned is called.
+func serveHTTPSd(listenAddress string, hd http.Handler) (func(), error) {
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(httpSdPath, hd)
+	server := httpdown.HTTP{
+		StopTimeout: 10 * time.Second,
+		KillTimeout: 1 * time.Second,
+	}.Serve(&http.Server{Handler: mux}, listener)
+	return func() {
+		if err := server.Stop(); err != nil {
+			log.Printf("error stopping the http_sd_configs server: %v", err)
+		}
+	}, nil
+}
+
+// newDiscovery returns the Discovery selected by cfg for a run using the
+// Prometheus servers managed by hs, which is empty if Prometheus is external.
+// The function returned stops serving the targets, if the Discovery does.
+func newDiscovery(ctx context.Context, cfg Config, hs []*harness.Harness) (*timedDiscovery, func(), error) {
+	var discoveries loadgen.MultiDiscovery
+	stop := func() {}
+	switch cfg.Discovery {
+	case loadgen.DiscoveryFile:
+		if len(hs) == 0 {
+			if cfg.SdConfigDir == "" {
+				return nil, nil, fmt.Errorf("file discovery for an external Prometheus needs an sd_config directory")
+			}
+			discoveries = append(discoveries, loadgen.NewFileDiscovery(cfg.SdConfigDir))
+		}
+		for _, h := range hs {
+			discoveries = append(discoveries, loadgen.NewFileDiscovery(h.GetSdCfgDir()))
+		}
+	case loadgen.DiscoveryStatic:
+		if len(hs) == 0 {
+			return nil, nil, fmt.Errorf("static discovery needs prombench to manage the Prometheus config")
+		}
+		for _, h := range hs {
+			h := h
+			discoveries = append(discoveries, loadgen.NewStaticDiscovery(ctx, func(groups []loadgen.TargetGroup) error {
+				sdcfg, err := harness.StaticSdConfig(groups)
+				if err != nil {
+					return err
+				}
+				return h.UpdateConfig(ctx, func(params *harness.ConfigParams) { params.TestSdConfig = sdcfg })
+			}))
+		}
+	case loadgen.DiscoveryHTTP:
+		// All the Prometheus servers poll the same endpoint.
+		hd := loadgen.NewHTTPDiscovery()
+		instance, err := cfg.HTTPSdInstance()
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't construct HTTP SD URL: %v", err)
+		}
+		if stop, err = serveHTTPSd(cfg.HTTPSdListenAddress, hd); err != nil {
+			return nil, nil, fmt.Errorf("can't serve targets for http_sd_configs: %v", err)
+		}
+		discoveries = append(discoveries, hd)
+		log.Printf("serving targets for http_sd_configs at http://%s%s", instance, httpSdPath)
+	default:
+		return nil, nil, fmt.Errorf("unsupported discovery mode %v", cfg.Discovery)
+	}
+	var discovery loadgen.Discovery = discoveries
+	if len(discoveries) == 1 {
+		discovery = discoveries[0]
+	}
+	return &timedDiscovery{Discovery: discovery, registered: make(map[string]time.Time)}, stop, nil
+}
+
+// reportDiscovery logs how long targets took to be scraped after being
+// registered, and records it in DiscoveryLatency.
+func reportDiscovery(cfg Config, td *timedDiscovery, scrapes loadgen.ScrapeLedger) {
+	first := make(map[string]time.Time)
+	for _, s := range scrapes {
+		if _, ok := first[s.Instance]; !ok {
+			first[s.Instance] = s.Time
+		}
+	}
+
+	td.mtx.Lock()
+	defer td.mtx.Unlock()
+	var total, max time.Duration
+	var discovered int
+	for instance, registered := range td.registered {
+		scraped, ok := first[instance]
+		if !ok {
+			continue
+		}
+		latency := scraped.Sub(registered)
+		DiscoveryLatency.WithLabelValues(cfg.Discovery.String()).Observe(latency.Seconds())
+		total += latency
+		if latency > max {
+			max = latency
+		}
+		discovered++
+	}
+	if discovered == 0 {
+		log.Printf("%s discovery: none of %d targets were scraped", cfg.Discovery, len(td.registered))
+		return
+	}
+	log.Printf("%s discovery: %d of %d targets scraped, %v mean and %v max from registration to first scrape",
+		cfg.Discovery, discovered, len(td.registered), total/time.Duration(discovered), max)
+}
@@ -0,0 +1,88 @@
+package prombench
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ncabatoff/prombench/loadgen"
+	api "github.com/prometheus/client_golang/api/prometheus"
+)
+
+// discoveryTimeout is how long, beyond a few scrape intervals, to wait for an
+// external Prometheus to start scraping all targets.
+const discoveryTimeout = time.Minute
+
+// promClient is how to reach a Prometheus for queries: its URL, and the
+// transport to send requests with, which adds any credentials.
+type promClient struct {
+	url       string
+	transport api.CancelableTransport
+}
+
+// queryAPI returns a client for the query API of pc.
+func (pc promClient) queryAPI() (api.QueryAPI, error) {
+	client, err := api.New(api.Config{Address: pc.url, Transport: pc.transport})
+	if err != nil {
+		return nil, err
+	}
+	return api.NewQueryAPI(client), nil
+}
+
+// authTransport adds credentials to requests to Prometheus.
+type authTransport struct {
+	api.CancelableTransport
+	username, password, bearerToken string
+}
+
+// newQueryTransport returns the transport to query Prometheus with, using the
+// credentials given in cfg if any.
+func newQueryTransport(cfg Config) api.CancelableTransport {
+	if cfg.PrometheusUsername == "" && cfg.PrometheusBearerToken == "" {
+		return api.DefaultTransport
+	}
+	return &authTransport{
+		CancelableTransport: api.DefaultTransport,
+		username:            cfg.PrometheusUsername,
+		password:            cfg.PrometheusPassword,
+		bearerToken:         cfg.PrometheusBearerToken,
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (at *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers mustn't modify the request they're given.
+	req = req.Clone(req.Context())
+	if at.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+at.bearerToken)
+	} else {
+		req.SetBasicAuth(at.username, at.password)
+	}
+	return at.CancelableTransport.RoundTrip(req)
+}
+
+// waitForDiscovery waits for an external Prometheus to scrape all targets, as
+// recorded by le.
+func waitForDiscovery(ctx context.Context, cfg Config, le loadgen.LoadExporter, targets int) {
+	start := time.Now()
+	timer := time.NewTimer(3*cfg.ScrapeInterval + discoveryTimeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		scraped := len(le.Scrapes().Instances())
+		if scraped >= targets {
+			log.Printf("all %d targets scraped after %v", targets, time.Since(start))
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			log.Printf("timed out waiting for discovery: only %d of %d targets scraped", scraped, targets)
+			return
+		case <-ticker.C:
+		}
+	}
+}
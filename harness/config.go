@@ -0,0 +1,147 @@
+package harness
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+type (
+	// ConfigParams are the settings used to render the Prometheus config.
+	ConfigParams struct {
+		// Template is the text of a Go template for prometheus.yml, or empty
+		// for DefaultConfigTemplate.
+		Template string
+		// ScrapeInterval is the scrape interval of the test job.
+		ScrapeInterval time.Duration
+		// PrombenchAddress and PrometheusAddress are where prombench and
+		// Prometheus can be scraped.
+		PrombenchAddress  string
+		PrometheusAddress string
+		// TestSdConfig is how the test job discovers its targets, as returned
+		// by one of FileSdConfig, StaticSdConfig or HTTPSdConfig.
+		TestSdConfig string
+		// TestMetricRelabelConfigs, if set, is the test job's
+		// metric_relabel_configs, as returned by DropMetricsRelabelConfig.
+		TestMetricRelabelConfigs string
+		// Scraper, if set, is sent with each scrape of the test job as the
+		// "prombench" URL parameter, so that the load exporters can tell
+		// which Prometheus made it.
+		Scraper string
+	}
+
+	// configData is what config templates are executed with.
+	configData struct {
+		ScrapeInterval           model.Duration
+		PrombenchAddress         string
+		PrometheusAddress        string
+		TestSdConfig             string
+		TestMetricRelabelConfigs string
+		SdConfigDir              string
+		Scraper                  string
+	}
+)
+
+// DefaultConfigTemplate is the Prometheus config used unless another template
+// is given.  Templates may use the fields ScrapeInterval, PrombenchAddress,
+// PrometheusAddress, SdConfigDir (relative to the test directory), Scraper,
+// TestSdConfig and TestMetricRelabelConfigs, the last two of which must be
+// indented by four spaces as below.  They may also use the templates defined
+// here: "scrape_configs" is the three standard jobs, and "test_job" is the
+// test job alone.
+const DefaultConfigTemplate = `{{define "test_job"}}  - job_name: 'test'
+    scrape_interval: '{{.ScrapeInterval}}'
+    {{.TestSdConfig}}
+{{- if .TestMetricRelabelConfigs}}
+    {{.TestMetricRelabelConfigs}}
+{{- end}}
+{{- if .Scraper}}
+    params:
+      prombench: [{{printf "%q" .Scraper}}]
+{{- end}}{{end}}
+{{- define "scrape_configs"}}  - job_name: 'prometheus'
+    scrape_interval: '1s'
+    static_configs:
+      - targets: [{{printf "%q" .PrometheusAddress}}]
+
+  - job_name: 'prombench'
+    scrape_interval: '1s'
+    static_configs:
+      - targets: [{{printf "%q" .PrombenchAddress}}]
+
+{{template "test_job" .}}{{end}}
+{{- define "prometheus.yml"}}global:
+scrape_configs:
+{{template "scrape_configs" .}}
+{{end}}`
+
+var testJobRegexp = regexp.MustCompile(`(?m)^\s*-?\s*job_name:\s*['"]?test['"]?\s*$`)
+
+// parseConfigTemplate parses text as a config template, along with the
+// templates defined by DefaultConfigTemplate.
+func parseConfigTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("default").Parse(DefaultConfigTemplate)
+	if err != nil {
+		return nil, err
+	}
+	if text == "" {
+		return tmpl.Lookup("prometheus.yml"), nil
+	}
+	tmpl, err = tmpl.New("user").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse config template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// RenderConfig returns the Prometheus config given by params, checking that it
+// still has a test job discovering the targets.
+func RenderConfig(params ConfigParams) (string, error) {
+	tmpl, err := parseConfigTemplate(params.Template)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, configData{
+		ScrapeInterval:           model.Duration(params.ScrapeInterval),
+		PrombenchAddress:         params.PrombenchAddress,
+		PrometheusAddress:        params.PrometheusAddress,
+		TestSdConfig:             params.TestSdConfig,
+		TestMetricRelabelConfigs: params.TestMetricRelabelConfigs,
+		SdConfigDir:              sdCfgDir,
+		Scraper:                  params.Scraper,
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to execute config template: %v", err)
+	}
+	cfgstr := buf.String()
+	if !testJobRegexp.MatchString(cfgstr) {
+		return "", fmt.Errorf("config has no job named 'test'")
+	}
+	if !strings.Contains(cfgstr, params.TestSdConfig) {
+		return "", fmt.Errorf("config doesn't use the test job's discovery config %q", params.TestSdConfig)
+	}
+	if params.Scraper != "" && !strings.Contains(cfgstr, fmt.Sprintf("prombench: [%q]", params.Scraper)) {
+		return "", fmt.Errorf("config doesn't send the test job's scrapes with the prombench parameter %q", params.Scraper)
+	}
+	return cfgstr, nil
+}
+
+// DropMetricsRelabelConfig returns the test job's metric_relabel_configs
+// dropping the metrics whose names match any of regexes.
+func DropMetricsRelabelConfig(regexes []string) string {
+	var buf bytes.Buffer
+	buf.WriteString("metric_relabel_configs:")
+	for _, re := range regexes {
+		fmt.Fprintf(&buf, `
+      - source_labels: [__name__]
+        regex: %q
+        action: drop`, re)
+	}
+	return buf.String()
+}
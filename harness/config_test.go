@@ -0,0 +1,94 @@
+package harness
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenderConfigDefault(t *testing.T) {
+	params := ConfigParams{
+		ScrapeInterval:           time.Second,
+		PrombenchAddress:         "localhost:9999",
+		PrometheusAddress:        "localhost:9090",
+		TestSdConfig:             FileSdConfig(),
+		TestMetricRelabelConfigs: DropMetricsRelabelConfig([]string{"a.*"}),
+		Scraper:                  "put",
+	}
+	want := `global:
+scrape_configs:
+  - job_name: 'prometheus'
+    scrape_interval: '1s'
+    static_configs:
+      - targets: ["localhost:9090"]
+
+  - job_name: 'prombench'
+    scrape_interval: '1s'
+    static_configs:
+      - targets: ["localhost:9999"]
+
+  - job_name: 'test'
+    scrape_interval: '1s'
+    file_sd_configs:
+      - files:
+        - 'sd_configs/*.json'
+    metric_relabel_configs:
+      - source_labels: [__name__]
+        regex: "a.*"
+        action: drop
+    params:
+      prombench: ["put"]
+`
+	got, err := RenderConfig(params)
+	if err != nil {
+		t.Fatalf("RenderConfig: %v", err)
+	}
+	if got != want {
+		t.Errorf("RenderConfig() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRenderConfigTemplate(t *testing.T) {
+	params := ConfigParams{
+		ScrapeInterval:    time.Second,
+		PrombenchAddress:  "localhost:9999",
+		PrometheusAddress: "localhost:9090",
+		TestSdConfig:      HTTPSdConfig("http://localhost:9997/sd"),
+		Scraper:           "put",
+	}
+	tests := []struct {
+		template string
+		ok       bool
+	}{
+		// Templates can use the default's pieces, or write the test job out.
+		{"global:\n  scrape_interval: 5s\nscrape_configs:\n{{template \"scrape_configs\" .}}\n", true},
+		{"scrape_configs:\n{{template \"test_job\" .}}\n", true},
+		{"scrape_configs:\n  - job_name: test\n    {{.TestSdConfig}}\n    params:\n      prombench: [{{printf \"%q\" .Scraper}}]\n", true},
+		// The test job is required.
+		{"scrape_configs:\n  - job_name: 'other'\n    {{.TestSdConfig}}\n", false},
+		{"global:\n  scrape_interval: 5s\n", false},
+		// It must discover the targets as told, and tell them who scrapes.
+		{"scrape_configs:\n  - job_name: 'test'\n    static_configs: []\n    params:\n      prombench: [{{printf \"%q\" .Scraper}}]\n", false},
+		{"scrape_configs:\n  - job_name: 'test'\n    {{.TestSdConfig}}\n", false},
+		// Templates must parse and execute.
+		{"scrape_configs:\n{{template \"test_job\" .}\n", false},
+		{"scrape_configs:\n{{template \"nosuchtemplate\" .}}\n", false},
+	}
+	for _, tt := range tests {
+		p := params
+		p.Template = tt.template
+		got, err := RenderConfig(p)
+		if tt.ok && err != nil {
+			t.Errorf("RenderConfig(%q): %v", tt.template, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("RenderConfig(%q) = %q, want error", tt.template, got)
+		}
+	}
+
+	// Without a scraper the prombench parameter isn't needed.
+	p := params
+	p.Scraper = ""
+	p.Template = "scrape_configs:\n  - job_name: 'test'\n    {{.TestSdConfig}}\n"
+	if _, err := RenderConfig(p); err != nil {
+		t.Errorf("RenderConfig(%q) without a scraper: %v", p.Template, err)
+	}
+}
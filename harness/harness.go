@@ -2,119 +2,239 @@ package harness
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 )
 
 const (
-	sdCfgDir = "sd_configs"
+	sdCfgDir    = "sd_configs"
+	configFile  = "prometheus.yml"
+	storagePath = "data"
 )
 
 type Harness struct {
 	testDirectory string
+	mtx           sync.Mutex
+	params        ConfigParams
+	cmd           *exec.Cmd
+	// done is closed when cmd exits.
+	done         chan struct{}
+	reloadMethod ReloadMethod
+	// reloadMtx serializes config updates.
+	reloadMtx sync.Mutex
 }
 
 func (h *Harness) GetSdCfgDir() string {
 	return filepath.Join(h.testDirectory, sdCfgDir)
 }
 
-func NewHarness(testDirectory string, rmIfPresent bool, scrapeInterval time.Duration, benchListenAddr, promListenAddr string) *Harness {
-	SetupTestDir(testDirectory, rmIfPresent)
-	h := &Harness{testDirectory}
-	h.setupPrometheusConfig(scrapeInterval, benchListenAddr, promListenAddr)
-	return h
+// NewHarness sets up testDirectory and the Prometheus config within it,
+// rendered as described by params.
+func NewHarness(testDirectory string, rmIfPresent bool, params ConfigParams) (*Harness, error) {
+	// Catch a bad template before deleting anything.
+	if _, err := RenderConfig(params); err != nil {
+		return nil, fmt.Errorf("bad Prometheus config: %v", err)
+	}
+	if err := SetupTestDir(testDirectory, rmIfPresent); err != nil {
+		return nil, err
+	}
+	h := &Harness{
+		testDirectory: testDirectory,
+		params:        params,
+	}
+	if err := h.writePrometheusConfig(); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(h.GetSdCfgDir(), 0700); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("unable to create sd_config dir '%s': %v", h.GetSdCfgDir(), err)
+	}
+	// TODO clean out sd_config dir
+	return h, nil
 }
 
-func SetupTestDir(dir string, rm bool) {
-	_, err := os.Open(dir)
-	if os.IsNotExist(err) {
-	} else if err != nil {
-		log.Fatalf("error opening test dir '%s': %v", dir, err)
-	} else if rm {
-		rmcmd := exec.Command("rm", "-rf", dir)
-		if err := rmcmd.Run(); err != nil {
-			log.Fatalf("error deleting test dir '%s': %v", dir, err)
+// FileSdConfig returns the test job's discovery config for targets written as
+// files to GetSdCfgDir.
+func FileSdConfig() string {
+	return fmt.Sprintf(`file_sd_configs:
+      - files:
+        - '%s/*.json'`, sdCfgDir)
+}
+
+// StaticSdConfig returns the test job's discovery config for a fixed list of
+// target groups, which must marshal to JSON in the file_sd format.
+func StaticSdConfig(targetGroups interface{}) (string, error) {
+	// YAML is a superset of JSON, and static_configs take the same format as
+	// file_sd files.
+	groups, err := json.Marshal(targetGroups)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal static targets: %v", err)
+	}
+	if string(groups) == "null" {
+		groups = []byte("[]")
+	}
+	return "static_configs: " + string(groups), nil
+}
+
+// HTTPSdConfig returns the test job's discovery config for targets served in
+// the file_sd format at url.
+func HTTPSdConfig(url string) string {
+	return fmt.Sprintf(`http_sd_configs:
+      - url: %q
+        refresh_interval: '1s'`, url)
+}
+
+// SetupTestDir creates dir, which if it already exists is first deleted if rm
+// is true, and otherwise is an error.
+func SetupTestDir(dir string, rm bool) error {
+	_, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return fmt.Errorf("error checking test dir '%s': %v", dir, err)
+	case !rm:
+		return fmt.Errorf("test dir '%s' exists but I wasn't asked to delete it", dir)
+	default:
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("error deleting test dir '%s': %v", dir, err)
 		}
-	} else {
-		log.Fatalf("error: test dir '%s' exists but I wasn't asked to delete it", dir)
 	}
 	if err := os.Mkdir(dir, 0700); err != nil {
-		log.Fatalf("error creating test dir '%s': %v", dir, err)
+		return fmt.Errorf("error creating test dir '%s': %v", dir, err)
 	}
+	return nil
 }
 
-func (h *Harness) setupPrometheusConfig(scrapeInterval time.Duration, benchListenAddr, promListenAddr string) {
-	cfgstr := fmt.Sprintf(`global:
-scrape_configs:
-  - job_name: 'prometheus'
-    scrape_interval: '1s'
-    static_configs:
-      - targets: [%q]
-
-  - job_name: 'prombench'
-    scrape_interval: '1s'
-    static_configs:
-      - targets: [%q]
-
-  - job_name: 'test'
-    scrape_interval: '%s'
-    file_sd_configs:
-      - files:
-        - '%s/*.json'`, promListenAddr, benchListenAddr, scrapeInterval, sdCfgDir)
+func (h *Harness) writePrometheusConfig() error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	cfgstr, err := RenderConfig(h.params)
+	if err != nil {
+		return err
+	}
 
-	cfgfilename := filepath.Join(h.testDirectory, "prometheus.yml")
+	cfgfilename := filepath.Join(h.testDirectory, configFile)
 	if err := ioutil.WriteFile(cfgfilename, []byte(cfgstr), 0600); err != nil {
-		log.Fatalf("unable to write config file '%s': %v", cfgfilename, err)
+		return fmt.Errorf("unable to write config file '%s': %v", cfgfilename, err)
 	}
-	if err := os.Mkdir(h.GetSdCfgDir(), 0700); err != nil && !os.IsExist(err) {
-		log.Fatalf("unable to create sd_config dir '%s': %v", h.GetSdCfgDir(), err)
-	}
-	// TODO clean out sd_config dir
+	return nil
 }
 
-func (h *Harness) StartPrometheus(ctx context.Context, prompath string, promargs []string) context.CancelFunc {
-	vercmd := exec.Command(prompath, "-version")
-	output, err := vercmd.Output()
-	if err != nil {
-		log.Fatalf("Prometheus returned %v", err)
+// StorageDir returns the directory in which Prometheus stores its data.
+func (h *Harness) StorageDir() string {
+	return filepath.Join(h.testDirectory, storagePath)
+}
+
+// PrometheusOptions returns the options Prometheus needs to use the config and
+// storage in the test directory.  Prometheus is run from the test directory, so
+// the paths are relative to it.
+func (h *Harness) PrometheusOptions() PrometheusOptions {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return PrometheusOptions{
+		ConfigFile:      configFile,
+		StoragePath:     storagePath,
+		EnableLifecycle: h.reloadMethod == ReloadHTTP,
 	}
-	log.Printf("Prometheus -version output: %s", string(output))
+}
 
-	myctx, cancel := context.WithCancel(ctx)
-	cmd := exec.CommandContext(myctx, prompath, promargs...)
+// StartPrometheus runs prompath with promargs in the test directory.  The
+// function returned stops Prometheus with SIGTERM, resorting to SIGKILL if it
+// hasn't exited within 30s, and so does cancelling ctx.
+func (h *Harness) StartPrometheus(ctx context.Context, prompath string, promargs []string) (context.CancelFunc, error) {
+	// Prometheus isn't run with ctx, which would SIGKILL it when cancelled.
+	killctx, kill := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(killctx, prompath, promargs...)
 	cmd.Dir = h.testDirectory
 	done := make(chan struct{})
 	promlog := filepath.Join(h.testDirectory, "prometheus.log")
-	logfile, err := os.Create(promlog)
+	// Append, so that the logs of a restarted Prometheus follow the earlier ones.
+	logfile, err := os.OpenFile(promlog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
-		log.Fatalf("unable to open log file '%s' for writing: %v", promlog, err)
+		kill()
+		return nil, fmt.Errorf("unable to open log file '%s' for writing: %v", promlog, err)
 	}
 	cmd.Stdout = logfile
 	cmd.Stderr = logfile
+	h.mtx.Lock()
+	h.cmd = cmd
+	h.done = done
+	h.mtx.Unlock()
+	log.Printf("running Prometheus in dir %q: %s %v", cmd.Dir, prompath, promargs)
+	if err := cmd.Start(); err != nil {
+		logfile.Close()
+		kill()
+		return nil, fmt.Errorf("unable to start Prometheus: %v", err)
+	}
 	go func() {
-		log.Printf("running Prometheus in dir %q: %s %v", cmd.Dir, prompath, promargs)
-		if err := cmd.Run(); err != nil {
+		if err := cmd.Wait(); err != nil {
 			log.Printf("Prometheus returned %v, see log %q", err, promlog)
 		} else {
 			log.Printf("Prometheus exited, see log %q", promlog)
 		}
-		done <- struct{}{}
+		logfile.Close()
+		close(done)
+		kill()
 	}()
 
-	return func() {
+	stop := func() {
 		cmd.Process.Signal(syscall.SIGTERM)
 		timer := time.NewTimer(30 * time.Second)
+		defer timer.Stop()
 		select {
 		case <-timer.C:
-			cancel()
+			kill()
 			<-done
 		case <-done:
 		}
 	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			stop()
+		case <-done:
+		}
+	}()
+	return stop, nil
+}
+
+// PrometheusPID returns the process ID of the running Prometheus, or 0 if it
+// isn't running.
+func (h *Harness) PrometheusPID() int {
+	h.mtx.Lock()
+	cmd, done := h.cmd, h.done
+	h.mtx.Unlock()
+	if cmd == nil {
+		return 0
+	}
+	select {
+	case <-done:
+		return 0
+	default:
+		return cmd.Process.Pid
+	}
+}
+
+// KillPrometheus kills the running Prometheus with SIGKILL, as if it had
+// crashed, and waits for it to exit.  It can then be started again on the same
+// test directory.
+func (h *Harness) KillPrometheus() error {
+	h.mtx.Lock()
+	cmd, done := h.cmd, h.done
+	h.mtx.Unlock()
+	if cmd == nil || cmd.Process == nil {
+		return fmt.Errorf("Prometheus isn't running")
+	}
+	if err := cmd.Process.Signal(syscall.SIGKILL); err != nil {
+		return fmt.Errorf("unable to kill Prometheus: %v", err)
+	}
+	<-done
+	return nil
 }
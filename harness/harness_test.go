@@ -0,0 +1,40 @@
+package harness
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetupTestDir(t *testing.T) {
+	parent, err := ioutil.TempDir("", "prombench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "test")
+
+	if err := SetupTestDir(dir, false); err != nil {
+		t.Fatalf("SetupTestDir of a new dir: %v", err)
+	}
+	stale := filepath.Join(dir, "data", "stale")
+	if err := os.MkdirAll(stale, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetupTestDir(dir, false); err == nil {
+		t.Errorf("SetupTestDir of an existing dir without rm succeeded")
+	}
+	if _, err := os.Stat(stale); err != nil {
+		t.Errorf("SetupTestDir without rm deleted the existing dir: %v", err)
+	}
+	if err := SetupTestDir(dir, true); err != nil {
+		t.Fatalf("SetupTestDir of an existing dir with rm: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("SetupTestDir with rm left the existing dir's contents: %v", err)
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		t.Errorf("SetupTestDir with rm didn't recreate the dir: %v", err)
+	}
+}
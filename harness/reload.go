@@ -0,0 +1,110 @@
+package harness
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"syscall"
+)
+
+// ReloadMethod is how Prometheus is told to reload its config.
+type ReloadMethod int
+
+const (
+	// ReloadSIGHUP sends Prometheus a SIGHUP.
+	ReloadSIGHUP ReloadMethod = iota
+	// ReloadHTTP posts to Prometheus's /-/reload endpoint, which since 2.0
+	// requires --web.enable-lifecycle.
+	ReloadHTTP
+)
+
+var reloadMethodNames = []string{
+	ReloadSIGHUP: "sighup",
+	ReloadHTTP:   "http",
+}
+
+func (m ReloadMethod) String() string {
+	if m < 0 || int(m) >= len(reloadMethodNames) {
+		return fmt.Sprintf("ReloadMethod(%d)", m)
+	}
+	return reloadMethodNames[m]
+}
+
+// ParseReloadMethod returns the ReloadMethod named name.
+func ParseReloadMethod(name string) (ReloadMethod, error) {
+	for i, n := range reloadMethodNames {
+		if n == name {
+			return ReloadMethod(i), nil
+		}
+	}
+	return ReloadSIGHUP, fmt.Errorf("invalid reload method '%s'", name)
+}
+
+// Set implements flag.Value.
+func (m *ReloadMethod) Set(name string) error {
+	method, err := ParseReloadMethod(name)
+	if err != nil {
+		return err
+	}
+	*m = method
+	return nil
+}
+
+// SetReloadMethod sets how Prometheus is told to reload its config, by default
+// ReloadSIGHUP.  It must be called before PrometheusOptions.
+func (h *Harness) SetReloadMethod(m ReloadMethod) {
+	h.mtx.Lock()
+	h.reloadMethod = m
+	h.mtx.Unlock()
+}
+
+// UpdateConfig applies update to the params the Prometheus config is rendered
+// from, rewrites the config, and tells Prometheus to reload it.  With
+// ReloadHTTP it returns once Prometheus has finished reloading, or ctx is
+// cancelled.
+func (h *Harness) UpdateConfig(ctx context.Context, update func(*ConfigParams)) error {
+	h.reloadMtx.Lock()
+	defer h.reloadMtx.Unlock()
+
+	h.mtx.Lock()
+	params := h.params
+	update(&params)
+	h.mtx.Unlock()
+	// Don't adopt a config that doesn't render.
+	if _, err := RenderConfig(params); err != nil {
+		return err
+	}
+	h.mtx.Lock()
+	h.params = params
+	cmd, method := h.cmd, h.reloadMethod
+	h.mtx.Unlock()
+	if err := h.writePrometheusConfig(); err != nil {
+		return err
+	}
+
+	if cmd == nil || cmd.Process == nil {
+		return nil
+	}
+	switch method {
+	case ReloadHTTP:
+		req, err := http.NewRequest("POST", "http://"+params.PrometheusAddress+"/-/reload", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("unable to ask Prometheus to reload its config: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("Prometheus failed to reload its config: %s: %s", resp.Status, body)
+		}
+	default:
+		if err := cmd.Process.Signal(syscall.SIGHUP); err != nil {
+			return fmt.Errorf("unable to signal Prometheus to reload its config: %v", err)
+		}
+	}
+	return nil
+}
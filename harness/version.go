@@ -0,0 +1,147 @@
+package harness
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// PrometheusVersion is the version of a Prometheus binary, which decides
+	// the command-line flags it accepts.
+	PrometheusVersion struct {
+		Major, Minor, Patch int
+	}
+
+	// PrometheusOptions are the settings the harness passes to Prometheus,
+	// translated by PrometheusVersion.Args into the flags of a given version.
+	PrometheusOptions struct {
+		ConfigFile    string
+		StoragePath   string
+		ListenAddress string
+		// Retention is how long to keep samples for, or zero for the default.
+		Retention time.Duration
+		// EnableAdminAPI enables the TSDB admin API, where there is one.
+		EnableAdminAPI bool
+		// EnableLifecycle enables reloading via /-/reload, which needs no
+		// flag before 2.0.
+		EnableLifecycle bool
+	}
+)
+
+var versionRegexp = regexp.MustCompile(`version (\d+)\.(\d+)\.(\d+)`)
+
+// GetPrometheusVersion runs the Prometheus binary at prompath to learn its
+// version.  It returns the raw output as well for logging.
+func GetPrometheusVersion(prompath string) (PrometheusVersion, string, error) {
+	// Both the flag package used by 1.x and the kingpin package used since
+	// 2.0 accept double dashes.
+	output, err := exec.Command(prompath, "--version").CombinedOutput()
+	if err != nil {
+		return PrometheusVersion{}, string(output), fmt.Errorf("Prometheus returned %v", err)
+	}
+	v, err := ParsePrometheusVersion(string(output))
+	return v, string(output), err
+}
+
+// ParsePrometheusVersion parses the output of prometheus --version.
+func ParsePrometheusVersion(output string) (PrometheusVersion, error) {
+	m := versionRegexp.FindStringSubmatch(output)
+	if m == nil {
+		return PrometheusVersion{}, fmt.Errorf("can't find version in Prometheus output %q", output)
+	}
+	var v PrometheusVersion
+	v.Major, _ = strconv.Atoi(m[1])
+	v.Minor, _ = strconv.Atoi(m[2])
+	v.Patch, _ = strconv.Atoi(m[3])
+	return v, nil
+}
+
+func (v PrometheusVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// AtLeast returns true if v is major.minor or later.
+func (v PrometheusVersion) AtLeast(major, minor int) bool {
+	return v.Major > major || v.Major == major && v.Minor >= minor
+}
+
+// Flag returns the flag name as given on the command line, e.g. --config.file.
+func (v PrometheusVersion) Flag(name string) string {
+	if v.AtLeast(2, 0) {
+		return "--" + name
+	}
+	return "-" + name
+}
+
+// RetentionFlag returns the name of the flag setting retention by time.
+func (v PrometheusVersion) RetentionFlag() string {
+	switch {
+	case v.AtLeast(2, 8):
+		return "storage.tsdb.retention.time"
+	case v.AtLeast(2, 0):
+		return "storage.tsdb.retention"
+	}
+	return "storage.local.retention"
+}
+
+// Args returns the command-line flags setting opts for Prometheus version v.
+func (v PrometheusVersion) Args(opts PrometheusOptions) []string {
+	storageFlag := "storage.local.path"
+	if v.AtLeast(2, 0) {
+		storageFlag = "storage.tsdb.path"
+	}
+	var args []string
+	if opts.ConfigFile != "" {
+		args = append(args, v.Flag("config.file"), opts.ConfigFile)
+	}
+	if opts.StoragePath != "" {
+		args = append(args, v.Flag(storageFlag), opts.StoragePath)
+	}
+	if opts.ListenAddress != "" {
+		args = append(args, v.Flag("web.listen-address"), opts.ListenAddress)
+	}
+	if opts.Retention > 0 {
+		args = append(args, v.Flag(v.RetentionFlag()), fmt.Sprintf("%ds", int(opts.Retention.Seconds())))
+	}
+	if opts.EnableAdminAPI && v.AtLeast(2, 0) {
+		args = append(args, v.Flag("web.enable-admin-api"))
+	}
+	if opts.EnableLifecycle && v.AtLeast(2, 0) {
+		args = append(args, v.Flag("web.enable-lifecycle"))
+	}
+	return args
+}
+
+// TranslateArgs rewrites user-supplied flags to suit version v: the dashes are
+// adjusted, and the retention flags of other versions are renamed.
+func (v PrometheusVersion) TranslateArgs(args []string) []string {
+	translated := make([]string, 0, len(args))
+	for _, arg := range args {
+		// Leave alone values, including negative numbers, and bare dashes.
+		if !strings.HasPrefix(arg, "-") || len(strings.TrimLeft(arg, "-")) == 0 ||
+			strings.IndexAny(arg[1:2], "0123456789.") == 0 {
+			translated = append(translated, arg)
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		value := ""
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value = name[:i], name[i:]
+		}
+		if len(name) == 1 {
+			// Short flags keep their single dash.
+			translated = append(translated, arg)
+			continue
+		}
+		switch name {
+		case "storage.local.retention", "storage.tsdb.retention", "storage.tsdb.retention.time":
+			name = v.RetentionFlag()
+		}
+		translated = append(translated, v.Flag(name)+value)
+	}
+	return translated
+}
@@ -0,0 +1,96 @@
+package harness
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParsePrometheusVersion(t *testing.T) {
+	tests := []struct {
+		output string
+		want   PrometheusVersion
+	}{
+		{"prometheus, version 1.8.2 (branch: HEAD, revision: 5211b96d4d1291c3dd1a569f711d3b301b635ecb)",
+			PrometheusVersion{1, 8, 2}},
+		{"prometheus, version 2.53.0 (branch: HEAD, revision: 4c35b9250afefede41c5f5acd76191f90f625898)\n  build user: root@7f6e3e4a3c1e",
+			PrometheusVersion{2, 53, 0}},
+		{"prometheus, version 3.0.0-rc.0 (branch: HEAD, revision: 2f3a4bc5a8c1b5d0a9a8e6a3e0f4d6c7b8a9e0f1)",
+			PrometheusVersion{3, 0, 0}},
+	}
+	for _, tt := range tests {
+		got, err := ParsePrometheusVersion(tt.output)
+		if err != nil {
+			t.Errorf("ParsePrometheusVersion(%q): %v", tt.output, err)
+		} else if got != tt.want {
+			t.Errorf("ParsePrometheusVersion(%q) = %v, want %v", tt.output, got, tt.want)
+		}
+	}
+
+	for _, output := range []string{"", "prometheus, version 2", "usage: prometheus [<flags>]"} {
+		if v, err := ParsePrometheusVersion(output); err == nil {
+			t.Errorf("ParsePrometheusVersion(%q) = %v, want error", output, v)
+		}
+	}
+}
+
+func TestTranslateArgs(t *testing.T) {
+	var (
+		v1  = PrometheusVersion{1, 8, 2}
+		v27 = PrometheusVersion{2, 7, 1}
+		v28 = PrometheusVersion{2, 8, 0}
+		v3  = PrometheusVersion{3, 0, 0}
+	)
+	tests := []struct {
+		v    PrometheusVersion
+		args []string
+		want []string
+	}{
+		{v1, []string{"--storage.local.memory-chunks", "1000", "--web.enable-admin-api"},
+			[]string{"-storage.local.memory-chunks", "1000", "-web.enable-admin-api"}},
+		{v28, []string{"-query.max-concurrency", "4", "-query.timeout=1m"},
+			[]string{"--query.max-concurrency", "4", "--query.timeout=1m"}},
+		// Negative numbers, bare dashes and short flags are left alone.
+		{v3, []string{"--some.offset", "-1", "-.5", "-", "-h"},
+			[]string{"--some.offset", "-1", "-.5", "-", "-h"}},
+		// Retention flags are renamed to the version's own.
+		{v1, []string{"--storage.tsdb.retention.time=1h"}, []string{"-storage.local.retention=1h"}},
+		{v27, []string{"-storage.local.retention", "1h"}, []string{"--storage.tsdb.retention", "1h"}},
+		{v28, []string{"--storage.tsdb.retention=1h"}, []string{"--storage.tsdb.retention.time=1h"}},
+		{v3, []string{"--storage.tsdb.retention.time", "1h"}, []string{"--storage.tsdb.retention.time", "1h"}},
+	}
+	for _, tt := range tests {
+		if got := tt.v.TranslateArgs(tt.args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v.TranslateArgs(%q) = %q, want %q", tt.v, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestArgs(t *testing.T) {
+	opts := PrometheusOptions{
+		ConfigFile:      "prometheus.yml",
+		StoragePath:     "data",
+		ListenAddress:   ":9090",
+		Retention:       time.Hour,
+		EnableAdminAPI:  true,
+		EnableLifecycle: true,
+	}
+	tests := []struct {
+		v    PrometheusVersion
+		want []string
+	}{
+		{PrometheusVersion{1, 8, 2}, []string{"-config.file", "prometheus.yml", "-storage.local.path", "data",
+			"-web.listen-address", ":9090", "-storage.local.retention", "3600s"}},
+		{PrometheusVersion{2, 7, 1}, []string{"--config.file", "prometheus.yml", "--storage.tsdb.path", "data",
+			"--web.listen-address", ":9090", "--storage.tsdb.retention", "3600s",
+			"--web.enable-admin-api", "--web.enable-lifecycle"}},
+		{PrometheusVersion{3, 0, 0}, []string{"--config.file", "prometheus.yml", "--storage.tsdb.path", "data",
+			"--web.listen-address", ":9090", "--storage.tsdb.retention.time", "3600s",
+			"--web.enable-admin-api", "--web.enable-lifecycle"}},
+	}
+	for _, tt := range tests {
+		if got := tt.v.Args(opts); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v.Args() = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
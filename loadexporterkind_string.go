@@ -4,9 +4,9 @@ package prombench
 
 import "fmt"
 
-const _LoadExporterKind_name = "ExporterIncExporterStaticExporterRandCyclicExporterOscillate"
+const _LoadExporterKind_name = "ExporterIncExporterStaticExporterRandCyclicExporterOscillateExporterCounterExporterHistogramExporterSummaryExporterChurn"
 
-var _LoadExporterKind_index = [...]uint8{0, 11, 25, 43, 60}
+var _LoadExporterKind_index = [...]uint8{0, 11, 25, 43, 60, 75, 92, 107, 120}
 
 func (i LoadExporterKind) String() string {
 	if i < 0 || i >= LoadExporterKind(len(_LoadExporterKind_index)-1) {
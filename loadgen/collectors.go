@@ -2,11 +2,18 @@ package loadgen
 
 import (
 	"fmt"
+	"github.com/beorn7/perks/quantile"
 	"github.com/prometheus/client_golang/prometheus"
+	"math"
 	"math/rand"
 	"strconv"
 )
 
+// metricName returns the name of the i-th metric exposed by a collector.
+func metricName(i int) string {
+	return fmt.Sprintf("test%d", i)
+}
+
 type (
 	incCollector struct {
 		descs      []*prometheus.Desc
@@ -18,7 +25,7 @@ type (
 func NewIncCollector(nmetrics, nlabels int) *incCollector {
 	descs := make([]*prometheus.Desc, nmetrics)
 	for i := 0; i < nmetrics; i++ {
-		metname := fmt.Sprintf("test%d", i)
+		metname := metricName(i)
 		descs[i] = prometheus.NewDesc(metname, metname, []string{"lab"}, nil)
 	}
 	return &incCollector{descs: descs, labelCount: nlabels}
@@ -46,6 +53,20 @@ func (t *incCollector) Sum() (int, error) {
 	return len(t.descs) * (t.labelCount) * t.cycle * (t.cycle + 1) / 2, nil
 }
 
+func (t *incCollector) Samples() (int, error) {
+	return len(t.descs) * t.labelCount * t.cycle, nil
+}
+
+func (t *incCollector) Ledger() (SeriesLedger, error) {
+	l := make(SeriesLedger)
+	for i := range t.descs {
+		for j := 0; j < t.labelCount; j++ {
+			l.Add(metricName(i), LabelKey("lab", strconv.Itoa(j)), t.cycle, float64(t.cycle*(t.cycle+1)/2))
+		}
+	}
+	return l, nil
+}
+
 type (
 	staticCollector struct {
 		descs      []*prometheus.Desc
@@ -59,7 +80,7 @@ func NewStaticCollector(nmetrics, nlabels int) *staticCollector {
 	descs := make([]*prometheus.Desc, nmetrics)
 	metrics := make([]prometheus.Metric, 0, nlabels*nmetrics)
 	for i := 0; i < nmetrics; i++ {
-		metname := fmt.Sprintf("test%d", i)
+		metname := metricName(i)
 		desc := prometheus.NewDesc(metname, metname, []string{"lab"}, nil)
 		descs[i] = desc
 		for j := 0; j < nlabels; j++ {
@@ -89,6 +110,20 @@ func (t *staticCollector) Sum() (int, error) {
 	return len(t.descs) * (t.labelCount) * t.cycle, nil
 }
 
+func (t *staticCollector) Samples() (int, error) {
+	return len(t.descs) * t.labelCount * t.cycle, nil
+}
+
+func (t *staticCollector) Ledger() (SeriesLedger, error) {
+	l := make(SeriesLedger)
+	for i := range t.descs {
+		for j := 0; j < t.labelCount; j++ {
+			l.Add(metricName(i), LabelKey("lab", strconv.Itoa(j)), t.cycle, float64(t.cycle))
+		}
+	}
+	return l, nil
+}
+
 type (
 	randCyclicCollector struct {
 		descs      []*prometheus.Desc
@@ -96,13 +131,15 @@ type (
 		labelCount int
 		cycle      int
 		sumvalues  int
+		// seriesSums are the per-series sums of exposed values.
+		seriesSums []int
 	}
 )
 
 func NewRandCyclicCollector(nmetrics, nlabels, maxvalue int) *randCyclicCollector {
 	descs := make([]*prometheus.Desc, nmetrics)
 	for i := 0; i < nmetrics; i++ {
-		metname := fmt.Sprintf("test%d", i)
+		metname := metricName(i)
 		desc := prometheus.NewDesc(metname, metname, []string{"lab"}, nil)
 		descs[i] = desc
 	}
@@ -113,7 +150,8 @@ func NewRandCyclicCollector(nmetrics, nlabels, maxvalue int) *randCyclicCollecto
 		values[i] = r
 		sum += r
 	}
-	return &randCyclicCollector{descs: descs, values: values, labelCount: nlabels, sumvalues: sum}
+	return &randCyclicCollector{descs: descs, values: values, labelCount: nlabels, sumvalues: sum,
+		seriesSums: make([]int, nlabels*nmetrics)}
 }
 
 // Describe implements prometheus.Collector.
@@ -127,11 +165,12 @@ func (t *randCyclicCollector) Describe(ch chan<- *prometheus.Desc) {
 func (t *randCyclicCollector) Collect(ch chan<- prometheus.Metric) {
 	i := t.cycle
 	t.cycle++
-	for _, desc := range t.descs {
+	for d, desc := range t.descs {
 		for j := 0; j < t.labelCount; j++ {
 			if i >= len(t.values) {
 				i = 0
 			}
+			t.seriesSums[d*t.labelCount+j] += t.values[i]
 			ch <- prometheus.MustNewConstMetric(desc,
 				prometheus.GaugeValue, float64(t.values[i]), strconv.Itoa(j))
 			i++
@@ -142,3 +181,437 @@ func (t *randCyclicCollector) Collect(ch chan<- prometheus.Metric) {
 func (t *randCyclicCollector) Sum() (int, error) {
 	return t.sumvalues * t.cycle, nil
 }
+
+func (t *randCyclicCollector) Samples() (int, error) {
+	return len(t.descs) * t.labelCount * t.cycle, nil
+}
+
+func (t *randCyclicCollector) Ledger() (SeriesLedger, error) {
+	l := make(SeriesLedger)
+	for i := range t.descs {
+		for j := 0; j < t.labelCount; j++ {
+			l.Add(metricName(i), LabelKey("lab", strconv.Itoa(j)), t.cycle, float64(t.seriesSums[i*t.labelCount+j]))
+		}
+	}
+	return l, nil
+}
+
+type (
+	counterCollector struct {
+		descs      []*prometheus.Desc
+		labelCount int
+		resetEvery int
+		cycle      int
+		value      int
+		sum        int
+		increase   int
+		resets     int
+	}
+)
+
+// NewCounterCollector returns a collector exposing counters that increase by
+// one on each scrape.  If resetEvery is positive, every resetEvery-th scrape
+// exposes a value of zero, i.e. a counter reset.
+func NewCounterCollector(nmetrics, nlabels, resetEvery int) *counterCollector {
+	descs := make([]*prometheus.Desc, nmetrics)
+	for i := 0; i < nmetrics; i++ {
+		metname := metricName(i)
+		descs[i] = prometheus.NewDesc(metname, metname, []string{"lab"}, nil)
+	}
+	return &counterCollector{descs: descs, labelCount: nlabels, resetEvery: resetEvery}
+}
+
+// Describe implements prometheus.Collector.
+func (t *counterCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range t.descs {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (t *counterCollector) Collect(ch chan<- prometheus.Metric) {
+	t.cycle++
+	prev := t.value
+	if t.resetEvery > 0 && t.cycle%t.resetEvery == 0 {
+		t.value = 0
+	} else {
+		t.value++
+	}
+	if t.cycle > 1 {
+		// Mirror how Prometheus computes increase(): after a reset, the
+		// post-reset value counts as the increase.
+		if t.value < prev {
+			t.resets++
+			t.increase += t.value
+		} else {
+			t.increase += t.value - prev
+		}
+	}
+	t.sum += t.value
+	for _, desc := range t.descs {
+		for j := 0; j < t.labelCount; j++ {
+			ch <- prometheus.MustNewConstMetric(desc,
+				prometheus.CounterValue, float64(t.value), strconv.Itoa(j))
+		}
+	}
+}
+
+func (t *counterCollector) Sum() (int, error) {
+	return len(t.descs) * t.labelCount * t.sum, nil
+}
+
+func (t *counterCollector) Samples() (int, error) {
+	return len(t.descs) * t.labelCount * t.cycle, nil
+}
+
+func (t *counterCollector) Ledger() (SeriesLedger, error) {
+	l := make(SeriesLedger)
+	for i := range t.descs {
+		for j := 0; j < t.labelCount; j++ {
+			l.Add(metricName(i), LabelKey("lab", strconv.Itoa(j)), t.cycle, float64(t.sum))
+		}
+	}
+	return l, nil
+}
+
+func (t *counterCollector) Increase() (CounterSum, error) {
+	nseries := len(t.descs) * t.labelCount
+	return CounterSum{Increase: nseries * t.increase, Resets: nseries * t.resets}, nil
+}
+
+// Distribution returns a random observation for histogram and summary collectors.
+type Distribution func() float64
+
+// Distributions maps the distribution names accepted in exporter specs to their
+// implementations.
+var Distributions = map[string]Distribution{
+	// uniform over [0,1)
+	"uniform": rand.Float64,
+	// exponential with mean 1
+	"exp": rand.ExpFloat64,
+	// normal with mean 1 and standard deviation 0.25, folded to be non-negative
+	"normal": func() float64 { return math.Abs(1 + rand.NormFloat64()/4) },
+}
+
+// observer accumulates the observations shared by all series of a histogram or
+// summary collector: each scrape, every series receives the same new observations.
+type observer struct {
+	dist         Distribution
+	obsPerScrape int
+	cycle        int
+	count        uint64
+	sum          float64
+	// emitted is the sum of all sample values exposed for a single series.
+	emitted float64
+	// countTotal and sumTotal are the sums of the _count and _sum values
+	// exposed for a single series.
+	countTotal float64
+	sumTotal   float64
+}
+
+// observe makes a scrape's worth of observations, passing each to f.
+func (o *observer) observe(f func(float64)) {
+	o.cycle++
+	for i := 0; i < o.obsPerScrape; i++ {
+		v := o.dist()
+		o.count++
+		o.sum += v
+		f(v)
+	}
+	o.countTotal += float64(o.count)
+	o.sumTotal += o.sum
+	o.emitted += float64(o.count) + o.sum
+}
+
+// addLedger records the _count and _sum series of the i-th metric with label
+// value lab.
+func (o *observer) addLedger(l SeriesLedger, i int, lab string) {
+	l.Add(metricName(i)+"_count", LabelKey("lab", lab), o.cycle, o.countTotal)
+	l.Add(metricName(i)+"_sum", LabelKey("lab", lab), o.cycle, o.sumTotal)
+}
+
+type (
+	histogramCollector struct {
+		observer
+		descs      []*prometheus.Desc
+		labelCount int
+		buckets    []float64
+		// counts are the cumulative bucket counts for buckets.
+		counts []uint64
+		// bucketTotals are the sums of the bucket values exposed for a single series.
+		bucketTotals []float64
+	}
+)
+
+// NewHistogramCollector returns a collector exposing histograms with the given
+// upper bucket bounds, which must be sorted and exclude +Inf.  Each scrape makes
+// obsPerScrape observations drawn from dist.
+func NewHistogramCollector(nmetrics, nlabels int, buckets []float64, dist Distribution, obsPerScrape int) *histogramCollector {
+	descs := make([]*prometheus.Desc, nmetrics)
+	for i := 0; i < nmetrics; i++ {
+		metname := metricName(i)
+		descs[i] = prometheus.NewDesc(metname, metname, []string{"lab"}, nil)
+	}
+	return &histogramCollector{
+		observer:     observer{dist: dist, obsPerScrape: obsPerScrape},
+		descs:        descs,
+		labelCount:   nlabels,
+		buckets:      buckets,
+		counts:       make([]uint64, len(buckets)),
+		bucketTotals: make([]float64, len(buckets)),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (t *histogramCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range t.descs {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (t *histogramCollector) Collect(ch chan<- prometheus.Metric) {
+	t.observe(func(v float64) {
+		for i, b := range t.buckets {
+			if v <= b {
+				t.counts[i]++
+			}
+		}
+	})
+	buckets := make(map[float64]uint64, len(t.buckets))
+	for i, b := range t.buckets {
+		buckets[b] = t.counts[i]
+		t.bucketTotals[i] += float64(t.counts[i])
+		t.emitted += float64(t.counts[i])
+	}
+	// +Inf bucket
+	t.emitted += float64(t.count)
+	for _, desc := range t.descs {
+		for j := 0; j < t.labelCount; j++ {
+			ch <- prometheus.MustNewConstHistogram(desc, t.count, t.sum, buckets, strconv.Itoa(j))
+		}
+	}
+}
+
+func (t *histogramCollector) Sum() (int, error) {
+	return int(float64(len(t.descs)*t.labelCount)*t.emitted + 0.5), nil
+}
+
+func (t *histogramCollector) Samples() (int, error) {
+	// buckets plus +Inf, _count and _sum
+	return len(t.descs) * t.labelCount * (len(t.buckets) + 3) * t.cycle, nil
+}
+
+func (t *histogramCollector) Ledger() (SeriesLedger, error) {
+	l := make(SeriesLedger)
+	for i := range t.descs {
+		for j := 0; j < t.labelCount; j++ {
+			lab := strconv.Itoa(j)
+			for b, bound := range t.buckets {
+				l.Add(metricName(i)+"_bucket", LabelKey("lab", lab, "le", formatBound(bound)), t.cycle, t.bucketTotals[b])
+			}
+			l.Add(metricName(i)+"_bucket", LabelKey("lab", lab, "le", formatBound(math.Inf(1))), t.cycle, t.countTotal)
+			t.addLedger(l, i, lab)
+		}
+	}
+	return l, nil
+}
+
+func (t *histogramCollector) Observations() (ObservationSum, error) {
+	nseries := len(t.descs) * t.labelCount
+	buckets := make([]BucketCount, len(t.buckets))
+	for i, b := range t.buckets {
+		buckets[i] = BucketCount{UpperBound: b, Count: nseries * int(t.counts[i])}
+	}
+	return ObservationSum{
+		Buckets: buckets,
+		Count:   nseries * int(t.count),
+		Sum:     float64(nseries) * t.sum,
+	}, nil
+}
+
+type (
+	summaryCollector struct {
+		observer
+		descs      []*prometheus.Desc
+		labelCount int
+		stream     *quantile.Stream
+		// quantileTotals are the sums of the quantile values exposed for a single series.
+		quantileTotals map[float64]float64
+	}
+)
+
+// NewSummaryCollector returns a collector exposing summaries with the default
+// objectives.  Each scrape makes obsPerScrape observations drawn from dist.
+func NewSummaryCollector(nmetrics, nlabels int, dist Distribution, obsPerScrape int) *summaryCollector {
+	descs := make([]*prometheus.Desc, nmetrics)
+	for i := 0; i < nmetrics; i++ {
+		metname := metricName(i)
+		descs[i] = prometheus.NewDesc(metname, metname, []string{"lab"}, nil)
+	}
+	return &summaryCollector{
+		observer:   observer{dist: dist, obsPerScrape: obsPerScrape},
+		descs:      descs,
+		labelCount: nlabels,
+		stream:     quantile.NewTargeted(prometheus.DefObjectives),
+
+		quantileTotals: make(map[float64]float64, len(prometheus.DefObjectives)),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (t *summaryCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range t.descs {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (t *summaryCollector) Collect(ch chan<- prometheus.Metric) {
+	t.observe(t.stream.Insert)
+	quantiles := make(map[float64]float64, len(prometheus.DefObjectives))
+	for q := range prometheus.DefObjectives {
+		quantiles[q] = t.stream.Query(q)
+		t.quantileTotals[q] += quantiles[q]
+		t.emitted += quantiles[q]
+	}
+	for _, desc := range t.descs {
+		for j := 0; j < t.labelCount; j++ {
+			ch <- prometheus.MustNewConstSummary(desc, t.count, t.sum, quantiles, strconv.Itoa(j))
+		}
+	}
+}
+
+func (t *summaryCollector) Sum() (int, error) {
+	return int(float64(len(t.descs)*t.labelCount)*t.emitted + 0.5), nil
+}
+
+func (t *summaryCollector) Samples() (int, error) {
+	// quantiles plus _count and _sum
+	return len(t.descs) * t.labelCount * (len(prometheus.DefObjectives) + 2) * t.cycle, nil
+}
+
+func (t *summaryCollector) Ledger() (SeriesLedger, error) {
+	l := make(SeriesLedger)
+	for i := range t.descs {
+		for j := 0; j < t.labelCount; j++ {
+			lab := strconv.Itoa(j)
+			for q, total := range t.quantileTotals {
+				l.Add(metricName(i), LabelKey("lab", lab, "quantile", formatBound(q)), t.cycle, total)
+			}
+			t.addLedger(l, i, lab)
+		}
+	}
+	return l, nil
+}
+
+func (t *summaryCollector) Observations() (ObservationSum, error) {
+	nseries := len(t.descs) * t.labelCount
+	return ObservationSum{
+		Count: nseries * int(t.count),
+		Sum:   float64(nseries) * t.sum,
+	}, nil
+}
+
+type (
+	churnCollector struct {
+		descs  []*prometheus.Desc
+		labels []string
+		// since gives the cycle at which each of labels was first exposed.
+		since []int
+		// retired maps label values no longer exposed to how many scrapes
+		// exposed them.
+		retired     map[string]int
+		replace     int
+		every       int
+		cycle       int
+		next        int
+		replaced    int
+		seriesCount int
+	}
+)
+
+// NewChurnCollector returns a collector exposing static metrics whose label
+// values rotate: every churnEvery scrapes, the oldest fraction of the label
+// values is replaced by new ones, creating new series and abandoning old ones.
+func NewChurnCollector(nmetrics, nlabels int, fraction float64, churnEvery int) *churnCollector {
+	descs := make([]*prometheus.Desc, nmetrics)
+	for i := 0; i < nmetrics; i++ {
+		metname := metricName(i)
+		descs[i] = prometheus.NewDesc(metname, metname, []string{"lab"}, nil)
+	}
+	labels := make([]string, nlabels)
+	for j := range labels {
+		labels[j] = strconv.Itoa(j)
+	}
+	replace := int(fraction*float64(nlabels) + 0.5)
+	if replace < 1 {
+		replace = 1
+	}
+	return &churnCollector{descs: descs, labels: labels, since: make([]int, nlabels), retired: make(map[string]int),
+		replace: replace, every: churnEvery, next: nlabels}
+}
+
+// Describe implements prometheus.Collector.
+func (t *churnCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range t.descs {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (t *churnCollector) Collect(ch chan<- prometheus.Metric) {
+	t.cycle++
+	if t.cycle == 1 {
+		t.seriesCount = len(t.descs) * len(t.labels)
+		for j := range t.since {
+			t.since[j] = 1
+		}
+	} else if t.every > 0 && (t.cycle-1)%t.every == 0 {
+		// labels is used as a ring, the oldest values being replaced first.
+		for i := 0; i < t.replace && i < len(t.labels); i++ {
+			j := (t.replaced + i) % len(t.labels)
+			t.retired[t.labels[j]] = t.cycle - t.since[j]
+			t.labels[j] = strconv.Itoa(t.next)
+			t.since[j] = t.cycle
+			t.next++
+		}
+		t.replaced += t.replace
+		t.seriesCount = len(t.descs) * t.next
+	}
+	for _, desc := range t.descs {
+		for _, label := range t.labels {
+			ch <- prometheus.MustNewConstMetric(desc,
+				prometheus.GaugeValue, float64(1), label)
+		}
+	}
+}
+
+func (t *churnCollector) Sum() (int, error) {
+	return len(t.descs) * len(t.labels) * t.cycle, nil
+}
+
+func (t *churnCollector) Samples() (int, error) {
+	return len(t.descs) * len(t.labels) * t.cycle, nil
+}
+
+func (t *churnCollector) Ledger() (SeriesLedger, error) {
+	l := make(SeriesLedger)
+	for i := range t.descs {
+		for label, samples := range t.retired {
+			l.Add(metricName(i), LabelKey("lab", label), samples, float64(samples))
+		}
+		if t.cycle == 0 {
+			continue
+		}
+		for j, label := range t.labels {
+			samples := t.cycle - t.since[j] + 1
+			l.Add(metricName(i), LabelKey("lab", label), samples, float64(samples))
+		}
+	}
+	return l, nil
+}
+
+func (t *churnCollector) Series() (int, error) {
+	return t.seriesCount, nil
+}
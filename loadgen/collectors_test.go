@@ -0,0 +1,60 @@
+package loadgen
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestCounterCollectorIncrease(t *testing.T) {
+	tests := []struct {
+		resetEvery, cycles int
+		// values are the values exposed each cycle.
+		values []float64
+		want   CounterSum
+	}{
+		// The first value is the counter's start, not an increase.
+		{0, 1, []float64{1}, CounterSum{}},
+		{0, 4, []float64{1, 2, 3, 4}, CounterSum{Increase: 3}},
+		// Resetting every cycle leaves a counter that never changes, which
+		// Prometheus sees as neither increasing nor resetting.
+		{1, 4, []float64{0, 0, 0, 0}, CounterSum{}},
+		{2, 5, []float64{1, 0, 1, 0, 1}, CounterSum{Increase: 2, Resets: 2}},
+		{3, 7, []float64{1, 2, 0, 1, 2, 0, 1}, CounterSum{Increase: 4, Resets: 2}},
+		// A reset's new value counts as an increase, as in increase().
+		{4, 6, []float64{1, 2, 3, 0, 1, 2}, CounterSum{Increase: 4, Resets: 1}},
+	}
+	for _, tt := range tests {
+		// Every series counts alike, so the sums are six times one series'.
+		cc := NewCounterCollector(2, 3, tt.resetEvery)
+		sum := 0
+		for i := 0; i < tt.cycles; i++ {
+			ch := make(chan prometheus.Metric, 6)
+			cc.Collect(ch)
+			close(ch)
+			for m := range ch {
+				var pb dto.Metric
+				if err := m.Write(&pb); err != nil {
+					t.Fatal(err)
+				}
+				if got := pb.GetCounter().GetValue(); got != tt.values[i] {
+					t.Errorf("reset=%d: cycle %d exposed %v, want %v", tt.resetEvery, i+1, got, tt.values[i])
+					break
+				}
+			}
+			sum += int(tt.values[i])
+		}
+
+		want := CounterSum{Increase: 6 * tt.want.Increase, Resets: 6 * tt.want.Resets}
+		if got, err := cc.Increase(); err != nil || got != want {
+			t.Errorf("reset=%d: Increase() after %d cycles = %+v, %v, want %+v", tt.resetEvery, tt.cycles, got, err, want)
+		}
+		if got, err := cc.Sum(); err != nil || got != 6*sum {
+			t.Errorf("reset=%d: Sum() after %d cycles = %d, %v, want %d", tt.resetEvery, tt.cycles, got, err, 6*sum)
+		}
+		if got, err := cc.Samples(); err != nil || got != 6*tt.cycles {
+			t.Errorf("reset=%d: Samples() after %d cycles = %d, %v, want %d", tt.resetEvery, tt.cycles, got, err, 6*tt.cycles)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package loadgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Control operations understood by ServeControl.
+const (
+	ControlAdd     = "add"
+	ControlRemove  = "remove"
+	ControlScrapes = "scrapes"
+	ControlStop    = "stop"
+)
+
+type (
+	// ControlRequest is sent by LoadExporterExternal to a load_exporter
+	// worker process, one JSON object per line.
+	ControlRequest struct {
+		Op string `json:"op"`
+		// Port, Job and Spec describe the target to add for ControlAdd.
+		// Port alone identifies the target for ControlRemove.
+		Port int    `json:"port,omitempty"`
+		Job  string `json:"job,omitempty"`
+		Spec string `json:"spec,omitempty"`
+	}
+
+	// ControlResponse answers a ControlRequest.
+	ControlResponse struct {
+		Error   string        `json:"error,omitempty"`
+		Sums    []InstanceSum `json:"sums,omitempty"`
+		Scrapes ScrapeLedger  `json:"scrapes,omitempty"`
+	}
+)
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// ServeControl reads ControlRequests from r and applies them to le, writing a
+// ControlResponse to w for each.  Exporters are created from their spec using
+// newExporter.  It returns after a ControlStop request, or once r is exhausted,
+// in either case stopping le.
+func ServeControl(r io.Reader, w io.Writer, le LoadExporter, newExporter func(spec string) (Exporter, error)) error {
+	dec := json.NewDecoder(r)
+	enc := json.NewEncoder(w)
+	for {
+		var req ControlRequest
+		if err := dec.Decode(&req); err == io.EOF {
+			_, err := le.Stop()
+			return err
+		} else if err != nil {
+			le.Stop()
+			return fmt.Errorf("error reading control request: %v", err)
+		}
+
+		var resp ControlResponse
+		switch req.Op {
+		case ControlAdd:
+			exporter, err := newExporter(req.Spec)
+			if err == nil {
+				err = le.AddTarget(req.Port, req.Job, exporter)
+			}
+			resp.Error = errorString(err)
+		case ControlRemove:
+			resp.Error = errorString(le.RemoveTarget(req.Port))
+		case ControlScrapes:
+			resp.Scrapes = le.Scrapes()
+		case ControlStop:
+			sums, err := le.Stop()
+			resp.Sums, resp.Error = sums, errorString(err)
+			// The worker exits after this, so its scrapes go with its sums.
+			resp.Scrapes = le.Scrapes()
+			return enc.Encode(resp)
+		default:
+			resp.Error = fmt.Sprintf("unknown control operation '%s'", req.Op)
+		}
+		if err := enc.Encode(resp); err != nil {
+			le.Stop()
+			return fmt.Errorf("error writing control response: %v", err)
+		}
+	}
+}
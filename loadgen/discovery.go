@@ -0,0 +1,247 @@
+package loadgen
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// DiscoveryMode selects how Prometheus discovers load targets.
+type DiscoveryMode int
+
+const (
+	// DiscoveryFile writes a file_sd_configs file for each target.
+	DiscoveryFile DiscoveryMode = iota
+	// DiscoveryStatic renders all targets into a static_configs block,
+	// reloading Prometheus whenever they change.
+	DiscoveryStatic
+	// DiscoveryHTTP serves all targets from an http_sd_configs endpoint.
+	DiscoveryHTTP
+)
+
+var discoveryModeNames = []string{
+	DiscoveryFile:   "file",
+	DiscoveryStatic: "static",
+	DiscoveryHTTP:   "http",
+}
+
+func (m DiscoveryMode) String() string {
+	if m < 0 || int(m) >= len(discoveryModeNames) {
+		return fmt.Sprintf("DiscoveryMode(%d)", m)
+	}
+	return discoveryModeNames[m]
+}
+
+// ParseDiscoveryMode returns the DiscoveryMode named name.
+func ParseDiscoveryMode(name string) (DiscoveryMode, error) {
+	for i, n := range discoveryModeNames {
+		if n == name {
+			return DiscoveryMode(i), nil
+		}
+	}
+	return DiscoveryFile, fmt.Errorf("invalid discovery mode '%s'", name)
+}
+
+// Set implements flag.Value.
+func (m *DiscoveryMode) Set(name string) error {
+	mode, err := ParseDiscoveryMode(name)
+	if err != nil {
+		return err
+	}
+	*m = mode
+	return nil
+}
+
+type (
+	// Discovery publishes load targets for Prometheus to scrape.
+	Discovery interface {
+		// Register publishes the target identified by id, to be scraped at
+		// addr with the given target labels.
+		Register(id int, addr string, labels map[string]string) error
+		// Deregister withdraws the target identified by id.
+		Deregister(id int) error
+	}
+
+	// TargetGroup is a set of targets sharing labels, in the format used by
+	// file_sd_configs, http_sd_configs and static_configs alike.
+	TargetGroup struct {
+		Targets []string          `json:"targets"`
+		Labels  map[string]string `json:"labels"`
+	}
+
+	// FileDiscovery is a Discovery writing a file_sd_configs file per target.
+	FileDiscovery struct {
+		dir string
+	}
+
+	// targetGroups holds a TargetGroup per registered target.
+	targetGroups struct {
+		mtx    sync.Mutex
+		groups map[int]TargetGroup
+	}
+
+	// HTTPDiscovery is a Discovery serving the registered targets to
+	// http_sd_configs.
+	HTTPDiscovery struct {
+		targetGroups
+	}
+
+	// StaticDiscovery is a Discovery that hands the registered targets to a
+	// function which renders them into the Prometheus config.
+	StaticDiscovery struct {
+		targetGroups
+		changed chan struct{}
+	}
+
+	// MultiDiscovery is a Discovery registering each target with all of its
+	// members, for when several Prometheus servers scrape the same targets.
+	MultiDiscovery []Discovery
+)
+
+// NewFileDiscovery returns a Discovery that writes a file for each target to dir.
+func NewFileDiscovery(dir string) *FileDiscovery {
+	return &FileDiscovery{dir: dir}
+}
+
+func (fd *FileDiscovery) Register(id int, addr string, labels map[string]string) error {
+	return writeSdConfigFile(addr, labels, sdConfigFilename(fd.dir, id))
+}
+
+func (fd *FileDiscovery) Deregister(id int) error {
+	filename := sdConfigFilename(fd.dir, id)
+	if err := os.Remove(filename); err != nil {
+		return fmt.Errorf("unable to remove sd_config file '%s': %v", filename, err)
+	}
+	return nil
+}
+
+func getSdFileContents(targetAddr string, labels map[string]string) (string, error) {
+	contents, err := json.MarshalIndent([]TargetGroup{{Targets: []string{targetAddr}, Labels: labels}}, "", "  ")
+	return string(contents), err
+}
+
+func writeSdConfigFile(targetAddr string, labels map[string]string, filename string) error {
+	sdcontents, err := getSdFileContents(targetAddr, labels)
+	if err == nil {
+		err = ioutil.WriteFile(filename, []byte(sdcontents), 0600)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write sd_config file '%s': %v", filename, err)
+	}
+	return nil
+}
+
+func sdConfigFilename(sdcfgdir string, port int) string {
+	return filepath.Join(sdcfgdir, fmt.Sprintf("load-%d.json", port))
+}
+
+func (tg *targetGroups) Register(id int, addr string, labels map[string]string) error {
+	tg.mtx.Lock()
+	defer tg.mtx.Unlock()
+	if tg.groups == nil {
+		tg.groups = make(map[int]TargetGroup)
+	}
+	tg.groups[id] = TargetGroup{Targets: []string{addr}, Labels: labels}
+	return nil
+}
+
+func (tg *targetGroups) Deregister(id int) error {
+	tg.mtx.Lock()
+	defer tg.mtx.Unlock()
+	delete(tg.groups, id)
+	return nil
+}
+
+// Groups returns the registered targets, ordered by id.
+func (tg *targetGroups) Groups() []TargetGroup {
+	tg.mtx.Lock()
+	defer tg.mtx.Unlock()
+	ids := make([]int, 0, len(tg.groups))
+	for id := range tg.groups {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	groups := make([]TargetGroup, 0, len(ids))
+	for _, id := range ids {
+		groups = append(groups, tg.groups[id])
+	}
+	return groups
+}
+
+// NewHTTPDiscovery returns a Discovery that serves its targets over HTTP.
+func NewHTTPDiscovery() *HTTPDiscovery {
+	return &HTTPDiscovery{}
+}
+
+// ServeHTTP implements http.Handler.
+func (hd *HTTPDiscovery) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(hd.Groups()); err != nil {
+		log.Printf("error serving targets: %v", err)
+	}
+}
+
+// NewStaticDiscovery returns a Discovery that calls update with all targets
+// after they change, until ctx is done.  Targets registered or deregistered
+// while update is running are batched into the following call.
+func NewStaticDiscovery(ctx context.Context, update func([]TargetGroup) error) *StaticDiscovery {
+	sd := &StaticDiscovery{changed: make(chan struct{}, 1)}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sd.changed:
+				if err := update(sd.Groups()); err != nil {
+					log.Printf("error updating static targets: %v", err)
+				}
+			}
+		}
+	}()
+	return sd
+}
+
+func (sd *StaticDiscovery) Register(id int, addr string, labels map[string]string) error {
+	sd.targetGroups.Register(id, addr, labels)
+	sd.notify()
+	return nil
+}
+
+func (sd *StaticDiscovery) Deregister(id int) error {
+	sd.targetGroups.Deregister(id)
+	sd.notify()
+	return nil
+}
+
+// notify wakes up the goroutine calling update, unless it's already due to run.
+func (sd *StaticDiscovery) notify() {
+	select {
+	case sd.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (md MultiDiscovery) Register(id int, addr string, labels map[string]string) error {
+	for _, d := range md {
+		if err := d.Register(id, addr, labels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (md MultiDiscovery) Deregister(id int) error {
+	for _, d := range md {
+		if err := d.Deregister(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
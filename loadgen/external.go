@@ -0,0 +1,223 @@
+package loadgen
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+type (
+	// LoadExporterExternal is a LoadExporter that serves targets from
+	// load_exporter worker processes, so that they don't compete with
+	// prombench itself for CPU and GC.
+	LoadExporterExternal struct {
+		ctx        context.Context
+		discovery  Discovery
+		path       string
+		host       string
+		maxWorkers int
+		mtx        sync.Mutex
+		workers    []*exporterWorker
+		targets    int
+		// ports maps the port of each target to the worker serving it.
+		ports map[int]*exporterWorker
+		// stopped is set by Stop, after which the workers are gone and
+		// Scrapes returns stoppedScrapes, the scrapes they reported.
+		stopped        bool
+		stoppedScrapes ScrapeLedger
+	}
+
+	// exporterWorker is a load_exporter process serving targets, controlled
+	// via its stdin and stdout.
+	exporterWorker struct {
+		cmd   *exec.Cmd
+		stdin io.WriteCloser
+		enc   *json.Encoder
+		dec   *json.Decoder
+		mtx   sync.Mutex
+	}
+)
+
+// NewLoadExporterExternal returns a LoadExporter that runs the load_exporter
+// binary at path to serve targets, registering each with discovery.  If maxWorkers is positive, targets are spread over at most that many
+// processes, otherwise each target gets a process of its own.
+func NewLoadExporterExternal(ctx context.Context, discovery Discovery, path string, maxWorkers int) *LoadExporterExternal {
+	return &LoadExporterExternal{
+		ctx:        ctx,
+		discovery:  discovery,
+		path:       path,
+		host:       "localhost",
+		maxWorkers: maxWorkers,
+	}
+}
+
+// SetHost sets the host targets listen on and are registered for discovery as,
+// by default localhost.  It must be called before any targets are added.
+func (lee *LoadExporterExternal) SetHost(host string) {
+	lee.host = host
+}
+
+func (lee *LoadExporterExternal) startWorker() (*exporterWorker, error) {
+	cmd := exec.CommandContext(lee.ctx, lee.path, "-control", "-target-host", lee.host)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to start load exporter %q: %v", lee.path, err)
+	}
+	return &exporterWorker{
+		cmd:   cmd,
+		stdin: stdin,
+		enc:   json.NewEncoder(stdin),
+		dec:   json.NewDecoder(stdout),
+	}, nil
+}
+
+// call sends req to the worker and returns its response.
+func (w *exporterWorker) call(req ControlRequest) (ControlResponse, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	var resp ControlResponse
+	if err := w.enc.Encode(req); err != nil {
+		return resp, fmt.Errorf("error sending %s request to load exporter: %v", req.Op, err)
+	}
+	if err := w.dec.Decode(&resp); err != nil {
+		return resp, fmt.Errorf("error reading %s response from load exporter: %v", req.Op, err)
+	}
+	if resp.Error != "" {
+		return resp, fmt.Errorf("load exporter %s request failed: %s", req.Op, resp.Error)
+	}
+	return resp, nil
+}
+
+// worker returns the worker process to add the next target to, starting a new
+// one if needed.
+func (lee *LoadExporterExternal) worker() (*exporterWorker, error) {
+	lee.mtx.Lock()
+	defer lee.mtx.Unlock()
+	var w *exporterWorker
+	if lee.maxWorkers <= 0 || len(lee.workers) < lee.maxWorkers {
+		var err error
+		if w, err = lee.startWorker(); err != nil {
+			return nil, err
+		}
+		lee.workers = append(lee.workers, w)
+	} else {
+		w = lee.workers[lee.targets%len(lee.workers)]
+	}
+	lee.targets++
+	return w, nil
+}
+
+func (lee *LoadExporterExternal) AddTarget(port int, job string, exporter Exporter) error {
+	se, ok := exporter.(SpecExporter)
+	if !ok {
+		return fmt.Errorf("LoadExporterExternal requires a SpecExporter, got %v", exporter)
+	}
+	w, err := lee.worker()
+	if err != nil {
+		return fmt.Errorf("unable to add target: %v", err)
+	}
+	if _, err := w.call(ControlRequest{Op: ControlAdd, Port: port, Job: job, Spec: se.Spec()}); err != nil {
+		return fmt.Errorf("unable to add target: %v", err)
+	}
+	targetAddr := net.JoinHostPort(lee.host, strconv.Itoa(port))
+	if err := lee.discovery.Register(port, targetAddr, map[string]string{"job": job}); err != nil {
+		// Don't leave the worker serving a target that was never discovered.
+		if _, rerr := w.call(ControlRequest{Op: ControlRemove, Port: port}); rerr != nil {
+			log.Printf("error removing target that failed to register: %v", rerr)
+		}
+		return fmt.Errorf("unable to add target: %v", err)
+	}
+	lee.mtx.Lock()
+	if lee.ports == nil {
+		lee.ports = make(map[int]*exporterWorker)
+	}
+	lee.ports[port] = w
+	lee.mtx.Unlock()
+	return nil
+}
+
+func (lee *LoadExporterExternal) RemoveTarget(port int) error {
+	lee.mtx.Lock()
+	w := lee.ports[port]
+	lee.mtx.Unlock()
+	if w == nil {
+		return fmt.Errorf("unable to remove target: no target on port %d", port)
+	}
+	if err := lee.discovery.Deregister(port); err != nil {
+		return fmt.Errorf("unable to remove target: %v", err)
+	}
+	if _, err := w.call(ControlRequest{Op: ControlRemove, Port: port}); err != nil {
+		return fmt.Errorf("unable to remove target: %v", err)
+	}
+	lee.mtx.Lock()
+	delete(lee.ports, port)
+	lee.mtx.Unlock()
+	return nil
+}
+
+func (lee *LoadExporterExternal) Scrapes() ScrapeLedger {
+	lee.mtx.Lock()
+	if lee.stopped {
+		defer lee.mtx.Unlock()
+		return append(ScrapeLedger(nil), lee.stoppedScrapes...)
+	}
+	workers := append([]*exporterWorker(nil), lee.workers...)
+	lee.mtx.Unlock()
+
+	var scrapes ScrapeLedger
+	for _, w := range workers {
+		resp, err := w.call(ControlRequest{Op: ControlScrapes})
+		if err != nil {
+			log.Printf("error fetching scrapes: %v", err)
+			continue
+		}
+		scrapes = append(scrapes, resp.Scrapes...)
+	}
+	sort.SliceStable(scrapes, func(i, j int) bool { return scrapes[i].Time.Before(scrapes[j].Time) })
+	return scrapes
+}
+
+// Stop tells each worker to stop serving and report its sums and scrapes, then
+// waits for it to exit.  The scrapes are kept for later calls to Scrapes.
+func (lee *LoadExporterExternal) Stop() ([]InstanceSum, error) {
+	lee.mtx.Lock()
+	defer lee.mtx.Unlock()
+	var sums []InstanceSum
+	var firstErr error
+	for _, w := range lee.workers {
+		resp, err := w.call(ControlRequest{Op: ControlStop})
+		if err == nil {
+			sums = append(sums, resp.Sums...)
+			lee.stoppedScrapes = append(lee.stoppedScrapes, resp.Scrapes...)
+		}
+		w.stdin.Close()
+		if werr := w.cmd.Wait(); err == nil && werr != nil {
+			err = fmt.Errorf("load exporter exited with error: %v", werr)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	lee.workers = nil
+	lee.stopped = true
+	sort.SliceStable(lee.stoppedScrapes, func(i, j int) bool {
+		return lee.stoppedScrapes[i].Time.Before(lee.stoppedScrapes[j].Time)
+	})
+	return sums, firstErr
+}
@@ -0,0 +1,68 @@
+package loadgen
+
+import (
+	"github.com/prometheus/common/model"
+	"strconv"
+)
+
+type (
+	// SeriesTotal is the number of samples exposed for a series and the sum
+	// of their values.
+	SeriesTotal struct {
+		Samples int
+		Sum     float64
+	}
+
+	// SeriesLedger records what an exporter has exposed: it maps each metric
+	// name to the series exposed under that name, keyed by their label set as
+	// formatted by model.LabelSet.String, to their totals.
+	SeriesLedger map[string]map[string]SeriesTotal
+)
+
+// LabelKey returns the ledger key for the label set given by alternating label
+// names and values.
+func LabelKey(nameValues ...string) string {
+	ls := make(model.LabelSet, len(nameValues)/2)
+	for i := 0; i+1 < len(nameValues); i += 2 {
+		ls[model.LabelName(nameValues[i])] = model.LabelValue(nameValues[i+1])
+	}
+	return ls.String()
+}
+
+// formatBound formats a histogram bucket bound or summary quantile the way it
+// appears as a label value once ingested.
+func formatBound(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Add records samples more samples summing to sum for the series of metric
+// name with label set key labels.
+func (l SeriesLedger) Add(name, labels string, samples int, sum float64) {
+	series, ok := l[name]
+	if !ok {
+		series = make(map[string]SeriesTotal)
+		l[name] = series
+	}
+	st := series[labels]
+	st.Samples += samples
+	st.Sum += sum
+	series[labels] = st
+}
+
+// AddLedger adds every total in other to l, multiplied by times.
+func (l SeriesLedger) AddLedger(other SeriesLedger, times int) {
+	for name, series := range other {
+		for labels, st := range series {
+			l.Add(name, labels, times*st.Samples, float64(times)*st.Sum)
+		}
+	}
+}
+
+// Series returns the number of series in l.
+func (l SeriesLedger) Series() int {
+	n := 0
+	for _, series := range l {
+		n += len(series)
+	}
+	return n
+}
@@ -7,10 +7,11 @@ import (
 	"github.com/facebookgo/httpdown"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"io/ioutil"
+	"github.com/prometheus/common/model"
 	"log"
+	"net"
 	"net/http"
-	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -19,20 +20,82 @@ type (
 	InstanceSum struct {
 		Instance string
 		Sum      int
+		// Counter is non-nil for exporters of counters.
+		Counter *CounterSum
+		// Observations is non-nil for exporters of histograms and summaries.
+		Observations *ObservationSum
+		// Series is non-zero for exporters that churn series, and gives the
+		// number of distinct series they've exposed.
+		Series int
+		// Ledger records every series the exporter exposed.
+		Ledger SeriesLedger
+		// Stopped is when the target was removed, or zero if it was served
+		// until the LoadExporter was stopped.
+		Stopped time.Time `json:",omitempty"`
+	}
+
+	// CounterSum totals the increase and number of counter resets over all
+	// the samples exposed by an exporter, summed across its series.
+	CounterSum struct {
+		Increase int
+		Resets   int
+	}
+
+	// ObservationSum totals the observations made by a histogram or summary
+	// exporter, summed across its series.
+	ObservationSum struct {
+		// Buckets are the cumulative histogram bucket counts, other than +Inf,
+		// in order of upper bound.  It's nil for summaries.
+		Buckets []BucketCount
+		Count   int
+		Sum     float64
+	}
+
+	BucketCount struct {
+		UpperBound float64
+		Count      int
 	}
 
 	LoadExporter interface {
 		AddTarget(port int, job string, exporter Exporter) error
+		// RemoveTarget stops serving the target added on port and withdraws
+		// it from discovery.  Its final sums are still returned by Stop, with
+		// Stopped set.
+		RemoveTarget(port int) error
 		Stop() ([]InstanceSum, error)
+		// Scrapes returns a record of every scrape served so far.
+		Scrapes() ScrapeLedger
 	}
 
 	MetricsGenerator interface {
 		prometheus.Collector
 		Sum() (int, error)
+		Samples() (int, error)
+		Ledger() (SeriesLedger, error)
 	}
 
 	Exporter interface {
 		Sum() (int, error)
+		// Samples returns the number of samples exposed so far.
+		Samples() (int, error)
+		// Ledger returns the per-series totals of all samples exposed so far.
+		Ledger() (SeriesLedger, error)
+	}
+
+	// CounterExporter is implemented by exporters of counters.
+	CounterExporter interface {
+		Increase() (CounterSum, error)
+	}
+
+	// ObservationExporter is implemented by exporters of histograms and summaries.
+	ObservationExporter interface {
+		Observations() (ObservationSum, error)
+	}
+
+	// ChurnExporter is implemented by exporters whose series change over time.
+	ChurnExporter interface {
+		// Series returns the number of distinct series ever exposed.
+		Series() (int, error)
 	}
 
 	HttpExporter interface {
@@ -45,48 +108,128 @@ type (
 		MetricsGenerator
 	}
 
+	// SpecExporter is an HttpExporter that can describe itself with an
+	// exporter spec, so that an equivalent exporter can be created in another
+	// process.
+	SpecExporter interface {
+		HttpExporter
+		Spec() string
+	}
+
+	specExporter struct {
+		HttpExporter
+		spec string
+	}
+
 	LoadExporterInternal struct {
 		ctx       context.Context
-		sdcfgdir  string
+		discovery Discovery
+		host      string
+		mux       *targetMux
 		cancel    func()
 		sumchan   chan InstanceSum
 		totalchan chan []InstanceSum
 		err       error
 		wg        sync.WaitGroup
+		scrapes   scrapeRecorder
+		mtx       sync.Mutex
+		targets   []*internalTarget
+	}
+
+	// internalTarget is a target served by LoadExporterInternal.  Its mutex
+	// serializes access to the exporter, whose collector may not be safe for
+	// concurrent use.
+	internalTarget struct {
+		// addr identifies the target, and is its instance label.
+		addr string
+		job  string
+		// scrapeAddr and metricsPath are where the target is served, if they
+		// differ from addr and /metrics.
+		scrapeAddr  string
+		metricsPath string
+		exporter    HttpExporter
+		mtx         sync.Mutex
+		// port is the port the target was added with, and stop is closed
+		// when it's removed at time stopped.
+		port    int
+		stop    chan struct{}
+		stopped time.Time
 	}
 )
 
-func getSdFileContents(targetAddr, job string) string {
-	return fmt.Sprintf(`[
-  {
-    "targets": [ "%s" ],
-    "labels": {
-	    "job": "%s"
-    }
-  }
-]`, targetAddr, job)
+func NewHttpExporter(mg MetricsGenerator) HttpExporter {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(mg)
+	return httpExporter{promhttp.HandlerFor(reg, promhttp.HandlerOpts{}), mg}
+}
+
+// WithSpec returns exporter annotated with the spec that created it.
+func WithSpec(exporter HttpExporter, spec string) SpecExporter {
+	return specExporter{exporter, spec}
+}
+
+func (se specExporter) Spec() string {
+	return se.spec
+}
+
+// generator returns the MetricsGenerator underlying exporter if there is one,
+// otherwise exporter itself.
+func generator(exporter Exporter) Exporter {
+	if se, ok := exporter.(specExporter); ok {
+		exporter = se.HttpExporter
+	}
+	if he, ok := exporter.(httpExporter); ok {
+		return he.MetricsGenerator
+	}
+	return exporter
 }
 
-func writeSdConfigFile(targetAddr, job, filename string) error {
-	sdcontents := getSdFileContents(targetAddr, job)
-	err := ioutil.WriteFile(filename, []byte(sdcontents), 0600)
+// counterSum returns the counter totals of exporter, or nil if it doesn't
+// export counters.
+func counterSum(exporter Exporter) (*CounterSum, error) {
+	ce, ok := generator(exporter).(CounterExporter)
+	if !ok {
+		return nil, nil
+	}
+	cs, err := ce.Increase()
 	if err != nil {
-		return fmt.Errorf("unable to write sd_config file '%s': %v", filename, err)
+		return nil, err
 	}
-	return nil
+	return &cs, nil
 }
 
-func NewHttpExporter(mg MetricsGenerator) HttpExporter {
-	reg := prometheus.NewRegistry()
-	reg.MustRegister(mg)
-	return httpExporter{promhttp.HandlerFor(reg, promhttp.HandlerOpts{}), mg}
+// observationSum returns the observation totals of exporter, or nil if it
+// doesn't export histograms or summaries.
+func observationSum(exporter Exporter) (*ObservationSum, error) {
+	oe, ok := generator(exporter).(ObservationExporter)
+	if !ok {
+		return nil, nil
+	}
+	obs, err := oe.Observations()
+	if err != nil {
+		return nil, err
+	}
+	return &obs, nil
+}
+
+// seriesCount returns the number of distinct series exposed by exporter, or 0
+// if it doesn't churn series.
+func seriesCount(exporter Exporter) (int, error) {
+	ce, ok := generator(exporter).(ChurnExporter)
+	if !ok {
+		return 0, nil
+	}
+	return ce.Series()
 }
 
-func NewLoadExporterInternal(ctx context.Context, sdcfgdir string) *LoadExporterInternal {
+// NewLoadExporterInternal returns a LoadExporter that serves targets from this
+// process, registering each with discovery unless it's nil.
+func NewLoadExporterInternal(ctx context.Context, discovery Discovery) *LoadExporterInternal {
 	lctx, cancel := context.WithCancel(ctx)
 	lei := &LoadExporterInternal{
 		ctx:       lctx,
-		sdcfgdir:  sdcfgdir,
+		discovery: discovery,
+		host:      "localhost",
 		cancel:    cancel,
 		sumchan:   make(chan InstanceSum),
 		totalchan: make(chan []InstanceSum),
@@ -101,6 +244,28 @@ func NewLoadExporterInternal(ctx context.Context, sdcfgdir string) *LoadExporter
 	return lei
 }
 
+// SetHost sets the host targets listen on and are registered for discovery as, by default localhost.  It must be called before any targets are added.
+func (lei *LoadExporterInternal) SetHost(host string) {
+	lei.host = host
+}
+
+// Sums returns the current sums of all targets without stopping them.
+func (lei *LoadExporterInternal) Sums() ([]InstanceSum, error) {
+	lei.mtx.Lock()
+	targets := append([]*internalTarget(nil), lei.targets...)
+	lei.mtx.Unlock()
+
+	sums := make([]InstanceSum, 0, len(targets))
+	for _, t := range targets {
+		sum, err := t.sum()
+		if err != nil {
+			return nil, err
+		}
+		sums = append(sums, sum)
+	}
+	return sums, nil
+}
+
 func (lei *LoadExporterInternal) Stop() ([]InstanceSum, error) {
 	lei.cancel()
 	lei.wg.Wait()
@@ -115,24 +280,127 @@ func (lei *LoadExporterInternal) AddTarget(port int, job string, exporter Export
 	} else {
 		return fmt.Errorf("LoadExporterInternal requires an HttpExporter, got %v", exporter)
 	}
-	targetAddr := fmt.Sprintf("localhost:%d", port)
-	cfgfilename := filepath.Join(lei.sdcfgdir, fmt.Sprintf("load-%d.json", port))
-	if err := writeSdConfigFile(targetAddr, job, cfgfilename); err != nil {
+	t := &internalTarget{addr: net.JoinHostPort(lei.host, strconv.Itoa(port)), job: job, exporter: hexporter,
+		port: port, stop: make(chan struct{})}
+	if lei.mux != nil {
+		if err := lei.mux.add(port, t, lei.scrapes.handler(t)); err != nil {
+			return fmt.Errorf("unable to add target: %v", err)
+		}
+	}
+	// Listen before registering the target, so that one that can't be
+	// served is never discovered.
+	var listener net.Listener
+	if lei.mux == nil {
+		var err error
+		if listener, err = net.Listen("tcp", t.addr); err != nil {
+			return fmt.Errorf("unable to add target: %v", err)
+		}
+	}
+	// Without a Discovery, whoever controls us is responsible for discovery.
+	if lei.discovery != nil {
+		if err := lei.discovery.Register(port, t.targetAddr(), t.sdLabels()); err != nil {
+			if listener != nil {
+				listener.Close()
+			} else {
+				lei.mux.discard(port, t)
+			}
+			return fmt.Errorf("unable to add target: %v", err)
+		}
+	}
 
-		return fmt.Errorf("unable to add target: %v", err)
+	if listener != nil {
+		lei.serve(t, listener)
 	}
+	lei.mtx.Lock()
+	lei.targets = append(lei.targets, t)
+	lei.mtx.Unlock()
 
-	go lei.start(targetAddr, hexporter)
+	return nil
+}
 
+func (lei *LoadExporterInternal) RemoveTarget(port int) error {
+	var t *internalTarget
+	lei.mtx.Lock()
+	for _, lt := range lei.targets {
+		if lt.port == port && lt.isRunning() {
+			t = lt
+			break
+		}
+	}
+	lei.mtx.Unlock()
+	if t == nil || !t.markStopped() {
+		return fmt.Errorf("unable to remove target: no target on port %d", port)
+	}
+
+	if lei.discovery != nil {
+		if err := lei.discovery.Deregister(port); err != nil {
+			return fmt.Errorf("unable to remove target: %v", err)
+		}
+	}
+	if lei.mux != nil {
+		lei.mux.remove(port)
+	}
 	return nil
 }
 
+// markStopped marks t stopped and tells it to stop serving, returning false if
+// it already was.  Holding t.mtx waits for any scrape in progress, so none is
+// served after stopped, and lets only one of concurrent removals through.
+// Multiplexed targets' sums are sent when the shared listener stops.
+func (t *internalTarget) markStopped() bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if !t.stopped.IsZero() {
+		return false
+	}
+	t.stopped = time.Now()
+	close(t.stop)
+	return true
+}
+
+// isRunning returns whether t hasn't been removed.
+func (t *internalTarget) isRunning() bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.stopped.IsZero()
+}
+
+// sum returns the sums of everything t has exposed so far.
+func (t *internalTarget) sum() (InstanceSum, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	sum, err := instanceSum(t.addr, t.exporter)
+	sum.Stopped = t.stopped
+	return sum, err
+}
+
+// targetAddr returns the address Prometheus should scrape t at.
+func (t *internalTarget) targetAddr() string {
+	if t.scrapeAddr != "" {
+		return t.scrapeAddr
+	}
+	return t.addr
+}
+
+// sdLabels returns the target labels to register t for discovery with.
+func (t *internalTarget) sdLabels() map[string]string {
+	labels := map[string]string{"job": t.job}
+	if t.metricsPath != "" {
+		labels[model.MetricsPathLabel] = t.metricsPath
+	}
+	if t.targetAddr() != t.addr {
+		labels[model.InstanceLabel] = t.addr
+	}
+	return labels
+}
+
 type (
 	dummyResponseWriter struct {
 		bytes.Buffer
-		header http.Header
-		code   int
-		sum    int
+		header  http.Header
+		code    int
+		sum     int
+		samples int
 	}
 )
 
@@ -149,10 +417,15 @@ func newDummyResponseWriter() *dummyResponseWriter {
 }
 
 type replayHandler struct {
-	dwrs     [2]*dummyResponseWriter
+	dwrs [2]*dummyResponseWriter
+	// ledgers are the series totals of the response in dwrs with the same index.
+	ledgers [2]SeriesLedger
+	// served counts how many times each response in dwrs has been served.
+	served   [2]int
 	mtx      sync.Mutex
 	replays  int
 	sum      int
+	samples  int
 	exporter HttpExporter
 }
 
@@ -166,18 +439,32 @@ func (rh *replayHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	idx := rh.replays % 2
 	rh.replays++
 	if rh.dwrs[idx] == nil {
-		rh.dwrs[idx] = newDummyResponseWriter()
-		rh.exporter.ServeHTTP(rh.dwrs[idx], req)
-		sum, err := rh.exporter.Sum()
-		if err != nil {
-			log.Fatalf("Error fetching exporter sum: %v", err)
-		} else {
-			rh.dwrs[idx].sum += sum
+		dwr := newDummyResponseWriter()
+		rh.exporter.ServeHTTP(dwr, req)
+		sum, err1 := rh.exporter.Sum()
+		samples, err2 := rh.exporter.Samples()
+		ledger, err3 := rh.exporter.Ledger()
+		for _, err := range []error{err1, err2, err3} {
+			if err != nil {
+				rh.replays--
+				rh.mtx.Unlock()
+				log.Printf("error recording exporter response: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 		}
+		dwr.sum += sum
+		dwr.samples += samples
+		rh.dwrs[idx] = dwr
+		rh.ledgers[idx] = make(SeriesLedger)
+		rh.ledgers[idx].AddLedger(ledger, 1)
 		if idx > 0 {
 			rh.dwrs[idx].sum -= rh.dwrs[idx-1].sum
+			rh.dwrs[idx].samples -= rh.dwrs[idx-1].samples
+			rh.ledgers[idx].AddLedger(rh.ledgers[idx-1], -1)
 		}
 	}
+	rh.served[idx]++
 	rh.mtx.Unlock()
 
 	header := w.Header()
@@ -189,6 +476,7 @@ func (rh *replayHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	w.Write(rh.dwrs[idx].Bytes())
 	rh.mtx.Lock()
 	rh.sum += rh.dwrs[idx].sum
+	rh.samples += rh.dwrs[idx].samples
 	rh.mtx.Unlock()
 }
 
@@ -196,34 +484,80 @@ func (rh *replayHandler) Sum() (int, error) {
 	return rh.sum, nil
 }
 
-func (lei *LoadExporterInternal) start(addr string, exporter HttpExporter) error {
-	server := &http.Server{Addr: addr, Handler: exporter}
+func (rh *replayHandler) Samples() (int, error) {
+	return rh.samples, nil
+}
+
+func (rh *replayHandler) Ledger() (SeriesLedger, error) {
+	rh.mtx.Lock()
+	defer rh.mtx.Unlock()
+	l := make(SeriesLedger)
+	for idx, ledger := range rh.ledgers {
+		l.AddLedger(ledger, rh.served[idx])
+	}
+	return l, nil
+}
+
+func (lei *LoadExporterInternal) Scrapes() ScrapeLedger {
+	return lei.scrapes.ledger()
+}
+
+// instanceSum gathers the totals of everything exporter has exposed as addr.
+func instanceSum(addr string, exporter Exporter) (InstanceSum, error) {
+	sum, err := exporter.Sum()
+	if err != nil {
+		return InstanceSum{}, fmt.Errorf("error fetching exporter sum: %v", err)
+	}
+	cs, err := counterSum(exporter)
+	if err != nil {
+		return InstanceSum{}, fmt.Errorf("error fetching exporter counter increase: %v", err)
+	}
+	obs, err := observationSum(exporter)
+	if err != nil {
+		return InstanceSum{}, fmt.Errorf("error fetching exporter observations: %v", err)
+	}
+	series, err := seriesCount(exporter)
+	if err != nil {
+		return InstanceSum{}, fmt.Errorf("error fetching exporter series count: %v", err)
+	}
+	ledger, err := exporter.Ledger()
+	if err != nil {
+		return InstanceSum{}, fmt.Errorf("error fetching exporter ledger: %v", err)
+	}
+	return InstanceSum{Instance: addr, Sum: sum, Counter: cs, Observations: obs,
+		Series: series, Ledger: ledger}, nil
+}
+
+// serve serves t on listener in the background until t or lei is stopped.
+func (lei *LoadExporterInternal) serve(t *internalTarget, listener net.Listener) {
+	server := &http.Server{Addr: t.addr, Handler: lei.scrapes.handler(t)}
 	hd := &httpdown.HTTP{
 		StopTimeout: 10 * time.Second,
 		KillTimeout: 1 * time.Second,
 	}
-	dserver, err := hd.ListenAndServe(server)
-	if err != nil {
-		return fmt.Errorf("unable to setup HTTP server: %v", err)
-	}
+	dserver := hd.Serve(server, listener)
 
 	lei.wg.Add(1)
-
 	go func() {
-		done := lei.ctx.Done()
-		<-done
+		select {
+		case <-lei.ctx.Done():
+		case <-t.stop:
+		}
 		err := dserver.Stop()
 		if err != nil {
 			log.Printf("error stopping HTTP server: %v", err)
 		}
-		sum, err := exporter.Sum()
-		if err != nil {
-			log.Printf("error fetching exporter sum: %v", err)
-		} else {
-			lei.sumchan <- InstanceSum{addr, sum}
-		}
+		lei.sendSum(t)
 		lei.wg.Done()
 	}()
+}
 
-	return nil
+// sendSum sends the final sums of t to be returned by Stop.
+func (lei *LoadExporterInternal) sendSum(t *internalTarget) {
+	sum, err := t.sum()
+	if err != nil {
+		log.Print(err)
+	} else {
+		lei.sumchan <- sum
+	}
 }
@@ -0,0 +1,63 @@
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// failDiscovery is a Discovery that can't register targets.
+type failDiscovery struct{}
+
+func (failDiscovery) Register(id int, addr string, labels map[string]string) error {
+	return fmt.Errorf("can't register %d", id)
+}
+
+func (failDiscovery) Deregister(id int) error {
+	return nil
+}
+
+// freePort returns a port nothing is listening on.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestAddTargetRegisterFailure(t *testing.T) {
+	for _, mode := range []MultiplexMode{MultiplexNone, MultiplexPath} {
+		lei := NewLoadExporterInternal(context.Background(), failDiscovery{})
+		muxPort := freePort(t)
+		if err := lei.SetMultiplex(mode, muxPort); err != nil {
+			t.Fatal(err)
+		}
+		port := freePort(t)
+		if err := lei.AddTarget(port, "test", NewHttpExporter(NewIncCollector(1, 1))); err == nil {
+			t.Errorf("%v: AddTarget succeeded despite discovery failing", mode)
+		}
+
+		url := fmt.Sprintf("http://localhost:%d/metrics", port)
+		if mode == MultiplexPath {
+			url = fmt.Sprintf("http://localhost:%d/target/%d/metrics", muxPort, port)
+		}
+		if resp, err := http.Get(url); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNotFound {
+				t.Errorf("%v: target that failed to register is served: %s", mode, resp.Status)
+			}
+		}
+
+		sums, err := lei.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sums) != 0 {
+			t.Errorf("%v: target that failed to register is in the sums: %+v", mode, sums)
+		}
+	}
+}
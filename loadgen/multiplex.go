@@ -0,0 +1,205 @@
+package loadgen
+
+import (
+	"fmt"
+	"github.com/facebookgo/httpdown"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MultiplexMode selects how LoadExporterInternal serves its targets.
+type MultiplexMode int
+
+const (
+	// MultiplexNone serves each target on its own port.
+	MultiplexNone MultiplexMode = iota
+	// MultiplexPath serves all targets on one port, each under the metrics
+	// path /target/<port>/metrics.
+	MultiplexPath
+	// MultiplexLoopback serves all targets on one port, each on its own
+	// loopback address 127.x.y.z derived from its port.  This relies on the
+	// whole of 127.0.0.0/8 being routed to the loopback interface, as on Linux.
+	MultiplexLoopback
+)
+
+var multiplexModeNames = []string{
+	MultiplexNone:     "none",
+	MultiplexPath:     "path",
+	MultiplexLoopback: "loopback",
+}
+
+func (m MultiplexMode) String() string {
+	if m < 0 || int(m) >= len(multiplexModeNames) {
+		return fmt.Sprintf("MultiplexMode(%d)", m)
+	}
+	return multiplexModeNames[m]
+}
+
+// ParseMultiplexMode returns the MultiplexMode named name.
+func ParseMultiplexMode(name string) (MultiplexMode, error) {
+	for i, n := range multiplexModeNames {
+		if n == name {
+			return MultiplexMode(i), nil
+		}
+	}
+	return MultiplexNone, fmt.Errorf("invalid multiplex mode '%s'", name)
+}
+
+// Set implements flag.Value.
+func (m *MultiplexMode) Set(name string) error {
+	mode, err := ParseMultiplexMode(name)
+	if err != nil {
+		return err
+	}
+	*m = mode
+	return nil
+}
+
+// targetMux is an http.Handler dispatching requests to the targets sharing a
+// single listener.
+type targetMux struct {
+	mode MultiplexMode
+	host string
+	port int
+	mtx  sync.RWMutex
+	// targets maps the path component or loopback IP identifying each target to it.
+	targets map[string]http.Handler
+	// ordered are the targets in the order they were added.
+	ordered []*internalTarget
+	server  httpdown.Server
+}
+
+// loopbackIP returns the loopback address used for the target given port.
+func loopbackIP(port int) string {
+	return net.IPv4(127, byte(port>>16), byte(port>>8), byte(port)).String()
+}
+
+// SetMultiplex makes lei serve all targets from a single listener on port,
+// distinguished as given by mode.  The port passed to AddTarget then merely
+// identifies the target.  It must be called before any targets are added.
+func (lei *LoadExporterInternal) SetMultiplex(mode MultiplexMode, port int) error {
+	if mode == MultiplexNone {
+		lei.mux = nil
+		return nil
+	}
+	mux := &targetMux{mode: mode, host: lei.host, port: port, targets: make(map[string]http.Handler)}
+	listenAddr := net.JoinHostPort(lei.host, strconv.Itoa(port))
+	if mode == MultiplexLoopback {
+		// Listen on all addresses, since we can't bind to all of 127.0.0.0/8.
+		listenAddr = fmt.Sprintf(":%d", port)
+	}
+	hd := &httpdown.HTTP{
+		StopTimeout: 10 * time.Second,
+		KillTimeout: 1 * time.Second,
+	}
+	server, err := hd.ListenAndServe(&http.Server{Addr: listenAddr, Handler: mux})
+	if err != nil {
+		return fmt.Errorf("unable to setup HTTP server: %v", err)
+	}
+	mux.server = server
+	lei.mux = mux
+
+	lei.wg.Add(1)
+	go func() {
+		<-lei.ctx.Done()
+		if err := server.Stop(); err != nil {
+			log.Printf("error stopping HTTP server: %v", err)
+		}
+		mux.mtx.RLock()
+		targets := mux.ordered
+		mux.mtx.RUnlock()
+		for _, t := range targets {
+			lei.sendSum(t)
+		}
+		lei.wg.Done()
+	}()
+	return nil
+}
+
+// add registers t to be served by h, setting its instance and scrape addresses
+// and metrics path.
+func (mux *targetMux) add(port int, t *internalTarget, h http.Handler) error {
+	portstr := strconv.Itoa(mux.port)
+	key := mux.key(port)
+	switch mux.mode {
+	case MultiplexPath:
+		t.scrapeAddr = net.JoinHostPort(mux.host, portstr)
+		t.metricsPath = "/target/" + key + "/metrics"
+		t.addr = t.scrapeAddr + "/target/" + key
+	case MultiplexLoopback:
+		t.addr = net.JoinHostPort(key, portstr)
+	}
+
+	mux.mtx.Lock()
+	defer mux.mtx.Unlock()
+	if _, ok := mux.targets[key]; ok {
+		return fmt.Errorf("target %s already exists", t.addr)
+	}
+	mux.targets[key] = h
+	mux.ordered = append(mux.ordered, t)
+	return nil
+}
+
+// remove stops serving the target added with port.  It's still included in
+// the sums sent when the listener stops.
+func (mux *targetMux) remove(port int) {
+	mux.mtx.Lock()
+	defer mux.mtx.Unlock()
+	delete(mux.targets, mux.key(port))
+}
+
+// discard undoes add for a target that was never discovered, so that it's
+// neither served nor included in the sums.
+func (mux *targetMux) discard(port int, t *internalTarget) {
+	mux.mtx.Lock()
+	defer mux.mtx.Unlock()
+	delete(mux.targets, mux.key(port))
+	// Copy rather than shift, since the sums may be read from the old slice.
+	ordered := make([]*internalTarget, 0, len(mux.ordered))
+	for _, ot := range mux.ordered {
+		if ot != t {
+			ordered = append(ordered, ot)
+		}
+	}
+	mux.ordered = ordered
+}
+
+// key returns the path component or loopback IP identifying the target added
+// with port.
+func (mux *targetMux) key(port int) string {
+	if mux.mode == MultiplexLoopback {
+		return loopbackIP(port)
+	}
+	return strconv.Itoa(port)
+}
+
+// ServeHTTP implements http.Handler.
+func (mux *targetMux) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var key string
+	switch mux.mode {
+	case MultiplexPath:
+		pieces := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+		if len(pieces) != 3 || pieces[0] != "target" || pieces[2] != "metrics" {
+			http.NotFound(w, req)
+			return
+		}
+		key = pieces[1]
+	case MultiplexLoopback:
+		if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			key, _, _ = net.SplitHostPort(addr.String())
+		}
+	}
+	mux.mtx.RLock()
+	h := mux.targets[key]
+	mux.mtx.RUnlock()
+	if h == nil {
+		http.NotFound(w, req)
+		return
+	}
+	h.ServeHTTP(w, req)
+}
@@ -0,0 +1,136 @@
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLoopbackIP(t *testing.T) {
+	tests := []struct {
+		port int
+		want string
+	}{
+		{1, "127.0.0.1"},
+		{10000, "127.0.39.16"},
+		{65535, "127.0.255.255"},
+		{70000, "127.1.17.112"},
+	}
+	for _, tt := range tests {
+		if got := loopbackIP(tt.port); got != tt.want {
+			t.Errorf("loopbackIP(%d) = %q, want %q", tt.port, got, tt.want)
+		}
+	}
+}
+
+// newTestMux returns a mux with a target added for each port, each answering
+// with its port.
+func newTestMux(t *testing.T, mode MultiplexMode, ports ...int) *targetMux {
+	mux := &targetMux{mode: mode, host: "localhost", port: 9000, targets: make(map[string]http.Handler)}
+	for _, port := range ports {
+		port := port
+		h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprint(w, port)
+		})
+		if err := mux.add(port, &internalTarget{port: port}, h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return mux
+}
+
+// serve returns the status and body of mux's response to a request for path
+// received on local address ip.
+func serve(mux *targetMux, ip, path string) (int, string) {
+	req := httptest.NewRequest("GET", path, nil)
+	addr := &net.TCPAddr{IP: net.ParseIP(ip), Port: mux.port}
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, addr))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func TestTargetMuxServeHTTP(t *testing.T) {
+	tests := []struct {
+		mode     MultiplexMode
+		ip, path string
+		want     string
+	}{
+		{MultiplexPath, "127.0.0.1", "/target/10000/metrics", "10000"},
+		{MultiplexPath, "127.0.0.1", "/target/10001/metrics", "10001"},
+		{MultiplexPath, "127.0.0.1", "/target/10002/metrics", ""},
+		{MultiplexPath, "127.0.0.1", "/target/10000", ""},
+		{MultiplexPath, "127.0.0.1", "/metrics", ""},
+		{MultiplexPath, "127.0.0.1", "/target/10000/metrics/x", ""},
+		// Loopback targets are told apart by the address they're reached
+		// on, whatever the path.
+		{MultiplexLoopback, "127.0.39.16", "/metrics", "10000"},
+		{MultiplexLoopback, "127.0.39.17", "/metrics", "10001"},
+		{MultiplexLoopback, "127.0.39.18", "/metrics", ""},
+		{MultiplexLoopback, "127.0.0.1", "/metrics", ""},
+	}
+	for _, tt := range tests {
+		mux := newTestMux(t, tt.mode, 10000, 10001)
+		code, body := serve(mux, tt.ip, tt.path)
+		if tt.want == "" {
+			if code != http.StatusNotFound {
+				t.Errorf("%v: %s%s = %d %q, want 404", tt.mode, tt.ip, tt.path, code, body)
+			}
+		} else if code != http.StatusOK || body != tt.want {
+			t.Errorf("%v: %s%s = %d %q, want target %s", tt.mode, tt.ip, tt.path, code, body, tt.want)
+		}
+	}
+}
+
+func TestTargetMuxAdd(t *testing.T) {
+	mux := newTestMux(t, MultiplexPath, 10000)
+	tgt := &internalTarget{port: 10001}
+	if err := mux.add(10001, tgt, http.NotFoundHandler()); err != nil {
+		t.Fatal(err)
+	}
+	if tgt.addr != "localhost:9000/target/10001" || tgt.scrapeAddr != "localhost:9000" || tgt.metricsPath != "/target/10001/metrics" {
+		t.Errorf("path target added as %q scraped at %q%s", tgt.addr, tgt.scrapeAddr, tgt.metricsPath)
+	}
+	if err := mux.add(10001, &internalTarget{port: 10001}, http.NotFoundHandler()); err == nil {
+		t.Errorf("adding a second target on port 10001 succeeded")
+	}
+
+	mux = newTestMux(t, MultiplexLoopback)
+	tgt = &internalTarget{port: 10001}
+	if err := mux.add(10001, tgt, http.NotFoundHandler()); err != nil {
+		t.Fatal(err)
+	}
+	if tgt.addr != "127.0.39.17:9000" || tgt.scrapeAddr != "" || tgt.metricsPath != "" {
+		t.Errorf("loopback target added as %q scraped at %q%s", tgt.addr, tgt.scrapeAddr, tgt.metricsPath)
+	}
+}
+
+func TestTargetMuxRemove(t *testing.T) {
+	mux := newTestMux(t, MultiplexPath, 10000, 10001, 10002)
+	mux.remove(10001)
+	for _, port := range []int{10000, 10001, 10002} {
+		code, _ := serve(mux, "127.0.0.1", fmt.Sprintf("/target/%d/metrics", port))
+		want := http.StatusOK
+		if port == 10001 {
+			want = http.StatusNotFound
+		}
+		if code != want {
+			t.Errorf("after removing 10001, target %d answered %d, want %d", port, code, want)
+		}
+	}
+	// Removed targets are still summed; discarded ones aren't.
+	if len(mux.ordered) != 3 {
+		t.Errorf("after removing a target %d remain to be summed, want 3", len(mux.ordered))
+	}
+	discarded := mux.ordered[2]
+	mux.discard(10002, discarded)
+	if code, _ := serve(mux, "127.0.0.1", "/target/10002/metrics"); code != http.StatusNotFound {
+		t.Errorf("discarded target answered %d, want 404", code)
+	}
+	if len(mux.ordered) != 2 || mux.ordered[0].port != 10000 || mux.ordered[1].port != 10001 {
+		t.Errorf("after discarding 10002, %d targets remain to be summed, want 10000 and 10001", len(mux.ordered))
+	}
+}
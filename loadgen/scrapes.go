@@ -0,0 +1,138 @@
+package loadgen
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ScraperParam is the URL parameter a Prometheus may add to its scrapes to
+// identify itself in the ScrapeLedger.
+const ScraperParam = "prombench"
+
+type (
+	// ScrapeRecord describes a single scrape served by a load exporter.
+	ScrapeRecord struct {
+		// Time is when the scrape request was received.
+		Time     time.Time
+		Instance string
+		Job      string
+		// Sum is the sum of the values of all samples in the response.
+		Sum int
+		// Samples is the number of samples in the response.
+		Samples int
+		// Scraper is the ScraperParam URL parameter of the scrape request,
+		// which identifies the Prometheus that made it when several scrape
+		// the same targets.
+		Scraper string
+	}
+
+	// ScrapeLedger is a record of scrapes, ordered by time.
+	ScrapeLedger []ScrapeRecord
+
+	// scrapeRecorder accumulates a ScrapeLedger from concurrently served scrapes.
+	scrapeRecorder struct {
+		mtx     sync.Mutex
+		records ScrapeLedger
+	}
+)
+
+// Window returns the total sum and number of samples of the scrapes of
+// instance received in the half-open interval (start, end].  An empty instance
+// matches all instances.
+func (sl ScrapeLedger) Window(instance string, start, end time.Time) (sum, samples int) {
+	first := sort.Search(len(sl), func(i int) bool { return sl[i].Time.After(start) })
+	for _, r := range sl[first:] {
+		if r.Time.After(end) {
+			break
+		}
+		if instance == "" || r.Instance == instance {
+			sum += r.Sum
+			samples += r.Samples
+		}
+	}
+	return sum, samples
+}
+
+// Instances returns the distinct instances in sl, sorted.
+func (sl ScrapeLedger) Instances() []string {
+	seen := make(map[string]bool)
+	var instances []string
+	for _, r := range sl {
+		if !seen[r.Instance] {
+			seen[r.Instance] = true
+			instances = append(instances, r.Instance)
+		}
+	}
+	sort.Strings(instances)
+	return instances
+}
+
+// Scraper returns the scrapes in sl made by scraper.
+func (sl ScrapeLedger) Scraper(scraper string) ScrapeLedger {
+	var scrapes ScrapeLedger
+	for _, r := range sl {
+		if r.Scraper == scraper {
+			scrapes = append(scrapes, r)
+		}
+	}
+	return scrapes
+}
+
+// ledger returns a copy of the scrapes recorded so far.
+func (sr *scrapeRecorder) ledger() ScrapeLedger {
+	sr.mtx.Lock()
+	defer sr.mtx.Unlock()
+	return append(ScrapeLedger(nil), sr.records...)
+}
+
+func (sr *scrapeRecorder) record(r ScrapeRecord) {
+	sr.mtx.Lock()
+	defer sr.mtx.Unlock()
+	// Scrapes of different targets can complete out of order, so insert in
+	// time order, searching from the end where r almost always belongs.
+	i := len(sr.records)
+	for i > 0 && sr.records[i-1].Time.After(r.Time) {
+		i--
+	}
+	sr.records = append(sr.records, ScrapeRecord{})
+	copy(sr.records[i+1:], sr.records[i:])
+	sr.records[i] = r
+}
+
+// handler returns an http.Handler serving t's exporter that records each
+// scrape.  Scrapes of the same target are serialized, since the sum and sample
+// count of each scrape are worked out from the exporter's running totals.
+func (sr *scrapeRecorder) handler(t *internalTarget) http.Handler {
+	exporter := t.exporter
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		now := time.Now()
+		t.mtx.Lock()
+		defer t.mtx.Unlock()
+		if !t.stopped.IsZero() {
+			http.NotFound(w, req)
+			return
+		}
+		sumBefore, err1 := exporter.Sum()
+		samplesBefore, err2 := exporter.Samples()
+		exporter.ServeHTTP(w, req)
+		sumAfter, err3 := exporter.Sum()
+		samplesAfter, err4 := exporter.Samples()
+		for _, err := range []error{err1, err2, err3, err4} {
+			if err != nil {
+				log.Printf("error recording scrape of %s: %v", t.addr, err)
+				return
+			}
+		}
+		sr.record(ScrapeRecord{
+			Time:     now,
+			Instance: t.addr,
+			Job:      t.job,
+			Sum:      sumAfter - sumBefore,
+			Samples:  samplesAfter - samplesBefore,
+			Scraper:  req.URL.Query().Get(ScraperParam),
+		})
+	})
+}
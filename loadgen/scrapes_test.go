@@ -0,0 +1,57 @@
+package loadgen
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScrapeLedgerWindow(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	at := func(s int) time.Time { return t0.Add(time.Duration(s) * time.Second) }
+	sl := ScrapeLedger{
+		{Time: at(1), Instance: "a", Sum: 1, Samples: 10},
+		{Time: at(1), Instance: "b", Sum: 2, Samples: 20},
+		{Time: at(2), Instance: "a", Sum: 4, Samples: 10},
+		{Time: at(3), Instance: "b", Sum: 8, Samples: 20},
+		{Time: at(4), Instance: "a", Sum: 16, Samples: 10},
+	}
+	tests := []struct {
+		instance     string
+		start, end   time.Time
+		sum, samples int
+	}{
+		{"", at(0), at(4), 31, 70},
+		{"a", at(0), at(4), 21, 30},
+		{"b", at(0), at(4), 10, 40},
+		// The start is excluded and the end included.
+		{"", at(1), at(3), 12, 30},
+		{"a", at(2), at(2), 0, 0},
+		{"", at(4), at(9), 0, 0},
+		{"c", at(0), at(4), 0, 0},
+	}
+	for _, tt := range tests {
+		sum, samples := sl.Window(tt.instance, tt.start, tt.end)
+		if sum != tt.sum || samples != tt.samples {
+			t.Errorf("Window(%q, %v, %v) = %d, %d, want %d, %d", tt.instance,
+				tt.start.Sub(t0), tt.end.Sub(t0), sum, samples, tt.sum, tt.samples)
+		}
+	}
+}
+
+func TestScrapeLedgerInstancesAndScraper(t *testing.T) {
+	sl := ScrapeLedger{
+		{Instance: "b", Scraper: "x"},
+		{Instance: "a", Scraper: "y"},
+		{Instance: "b", Scraper: "y"},
+	}
+	if got, want := sl.Instances(), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Instances() = %v, want %v", got, want)
+	}
+	if got, want := sl.Scraper("y"), sl[1:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Scraper(%q) = %v, want %v", "y", got, want)
+	}
+	if got := sl.Scraper("z"); len(got) != 0 {
+		t.Errorf("Scraper(%q) = %v, want none", "z", got)
+	}
+}
@@ -0,0 +1,475 @@
+package prombench
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ncabatoff/prombench/loadgen"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ScenarioPhase *prometheus.GaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prombench",
+			Subsystem: "scenario",
+			Name:      "phase",
+			Help:      "1 while the scenario phase is running, 0 once it has run, by phase name",
+		},
+		[]string{"phase"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(ScenarioPhase)
+}
+
+type (
+	// PhaseSpec is one phase of a scenario.  On entering it, the load
+	// targets are changed to Exporters, all at once or, if Ramp is set, one
+	// at a time spread evenly over Duration.  If ScrapeInterval is set the
+	// test job's scrape interval is changed by a reload.  Reloads are timed
+	// from the start of the phase, and RunIntervals run only during it.
+	PhaseSpec struct {
+		Name     string
+		Duration time.Duration
+		// Exporters, if nil, leaves the load targets as they were.
+		Exporters      ExporterSpecList
+		Ramp           bool
+		ScrapeInterval time.Duration
+		Reloads        ReloadSpecList
+		RunIntervals   RunIntervalSpecList
+	}
+
+	// Scenario is a run described in a file: Flags are prombench flag values
+	// by flag name, Args the Prometheus binary and its arguments, and Phases
+	// the load profile.
+	Scenario struct {
+		Flags  map[string]string
+		Args   []string
+		Phases []PhaseSpec
+	}
+
+	// PhaseResult is how Prometheus fared during one phase of a scenario.
+	PhaseResult struct {
+		Name  string    `json:"name"`
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+		// Targets is how many load targets were running at the end of the
+		// phase.
+		Targets int `json:"targets"`
+		// ScrapedSamples is the number of samples the load targets served
+		// during the phase, and StoredSamples how many of them Prometheus
+		// returns from queries; Completeness is their ratio.
+		ScrapedSamples   int     `json:"scraped_samples"`
+		StoredSamples    int     `json:"stored_samples"`
+		Completeness     float64 `json:"completeness"`
+		SamplesPerSecond float64 `json:"samples_per_second"`
+		// QueryLatencyMedian and QueryLatencyMax are of queryLatencyRuns runs
+		// of a sum over all load series for the phase, made as it ended and
+		// so possibly overlapping the start of the next phase.
+		QueryLatencyMedian float64 `json:"query_latency_median_seconds"`
+		QueryLatencyMax    float64 `json:"query_latency_max_seconds"`
+		MaxRSSBytes        int     `json:"max_rss_bytes"`
+		CPUSeconds         float64 `json:"cpu_seconds"`
+	}
+
+	// phaseRecord describes a phase as it ran.
+	phaseRecord struct {
+		Spec       PhaseSpec
+		Start, End time.Time
+		Targets    int
+		// QueryLatencyMedian and QueryLatencyMax are as in PhaseResult.
+		QueryLatencyMedian, QueryLatencyMax time.Duration
+	}
+
+	// targetMix tracks the load targets running by shape, so that they can
+	// be changed to match a different ExporterSpecList.
+	targetMix struct {
+		le       loadgen.LoadExporter
+		nextPort int
+		// shapes is the single target spec of each shape, keyed by its
+		// String(), and ports the ports of its targets, most recent last.
+		shapes map[string]ExporterSpec
+		ports  map[string][]int
+	}
+)
+
+// UnmarshalJSON reads a phase whose durations and lists are given in the
+// syntax of the corresponding prombench flags, e.g.
+// {"name": "spike", "duration": "1m", "exporters": "inc:50", "ramp": true}.
+func (ps *PhaseSpec) UnmarshalJSON(data []byte) error {
+	var aux struct {
+		Name           string  `json:"name"`
+		Duration       string  `json:"duration"`
+		Exporters      *string `json:"exporters"`
+		Ramp           bool    `json:"ramp"`
+		ScrapeInterval string  `json:"scrape-interval"`
+		Reload         string  `json:"reload"`
+		RunEvery       string  `json:"run-every"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	phase := PhaseSpec{Name: aux.Name, Ramp: aux.Ramp}
+	var err error
+	if phase.Duration, err = time.ParseDuration(aux.Duration); err != nil {
+		return fmt.Errorf("invalid duration in phase '%s': %v", aux.Name, err)
+	}
+	switch {
+	case aux.Exporters == nil:
+	case *aux.Exporters == "" || *aux.Exporters == "none":
+		// An empty mix, as opposed to none given, removes every target.
+		phase.Exporters = ExporterSpecList{}
+	default:
+		if err := phase.Exporters.Set(*aux.Exporters); err != nil {
+			return fmt.Errorf("bad exporters in phase '%s': %v", aux.Name, err)
+		}
+	}
+	if aux.ScrapeInterval != "" {
+		phase.ScrapeInterval, err = time.ParseDuration(aux.ScrapeInterval)
+		if err != nil || phase.ScrapeInterval <= 0 {
+			return fmt.Errorf("invalid scrape interval in phase '%s'", aux.Name)
+		}
+	}
+	if aux.Reload != "" {
+		if err := phase.Reloads.Set(aux.Reload); err != nil {
+			return fmt.Errorf("bad reloads in phase '%s': %v", aux.Name, err)
+		}
+	}
+	if aux.RunEvery != "" {
+		if err := phase.RunIntervals.Set(aux.RunEvery); err != nil {
+			return fmt.Errorf("bad run-every in phase '%s': %v", aux.Name, err)
+		}
+	}
+	*ps = phase
+	return nil
+}
+
+// LoadScenario reads a Scenario from the JSON file filename.  Flag values may
+// be JSON strings, numbers or booleans.
+func LoadScenario(filename string) (*Scenario, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var raw struct {
+		Flags  map[string]interface{} `json:"flags"`
+		Args   []string               `json:"args"`
+		Phases []PhaseSpec            `json:"phases"`
+	}
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("error parsing scenario %q: %v", filename, err)
+	}
+	sc := &Scenario{Flags: make(map[string]string), Args: raw.Args, Phases: raw.Phases}
+	for name, v := range raw.Flags {
+		switch v.(type) {
+		case string, json.Number, bool:
+			sc.Flags[name] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("scenario flag %q must be a string, number or boolean", name)
+		}
+	}
+	return sc, nil
+}
+
+// phased returns c with the test duration set to that of its phases, and the
+// reloads of its phases, including scrape interval changes, added to Reloads.
+// It returns c unchanged if it has no phases.
+func (c Config) phased() Config {
+	if len(c.Phases) == 0 {
+		return c
+	}
+	reloads := append(ReloadSpecList(nil), c.Reloads...)
+	var start time.Duration
+	for i, ps := range c.Phases {
+		if ps.ScrapeInterval > 0 {
+			if i == 0 {
+				c.ScrapeInterval = ps.ScrapeInterval
+			} else {
+				reloads = append(reloads, ReloadSpec{After: start, ScrapeInterval: ps.ScrapeInterval})
+			}
+		}
+		for _, rs := range ps.Reloads {
+			rs.After += start
+			reloads = append(reloads, rs)
+		}
+		start += ps.Duration
+	}
+	c.TestDuration = start
+	c.Reloads = reloads
+	return c
+}
+
+// validatePhases returns an error if the phases of c are unusable.
+func (c Config) validatePhases() error {
+	if c.AdaptiveInterval > 0 {
+		return fmt.Errorf("phases can't be combined with the adaptive search")
+	}
+	for _, ps := range c.Phases {
+		if ps.Duration <= 0 {
+			return fmt.Errorf("phase '%s' duration must be positive, not %v", ps.Name, ps.Duration)
+		}
+		if ps.Ramp && ps.Exporters == nil {
+			return fmt.Errorf("phase '%s' ramps but gives no exporters to ramp to", ps.Name)
+		}
+		for _, es := range ps.Exporters {
+			if _, err := NewExporter(es); err != nil {
+				return fmt.Errorf("bad exporter spec '%s' in phase '%s': %v", es.String(), ps.Name, err)
+			}
+		}
+		for _, rs := range ps.Reloads {
+			if rs.After >= ps.Duration {
+				return fmt.Errorf("reload after %v is beyond the duration %v of phase '%s'", rs.After, ps.Duration, ps.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// hasPhaseExporters returns true if some phase of c sets the load targets.
+func (c Config) hasPhaseExporters() bool {
+	for _, ps := range c.Phases {
+		if len(ps.Exporters) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// newTargetMix returns a targetMix of the targets started by startExporters
+// with esl and firstPort.
+func newTargetMix(le loadgen.LoadExporter, esl ExporterSpecList, firstPort int) *targetMix {
+	tm := &targetMix{
+		le:       le,
+		nextPort: firstPort,
+		shapes:   make(map[string]ExporterSpec),
+		ports:    make(map[string][]int),
+	}
+	for _, es := range esl {
+		key := tm.shape(es)
+		for i := 0; i < es.Count; i++ {
+			tm.ports[key] = append(tm.ports[key], tm.nextPort)
+			tm.nextPort++
+		}
+	}
+	return tm
+}
+
+// shape records the shape of es, returning its key.
+func (tm *targetMix) shape(es ExporterSpec) string {
+	es.Count = 1
+	key := es.String()
+	tm.shapes[key] = es
+	return key
+}
+
+// targets returns the number of targets running.
+func (tm *targetMix) targets() int {
+	n := 0
+	for _, ports := range tm.ports {
+		n += len(ports)
+	}
+	return n
+}
+
+// changes returns the steps that take the targets running to those of esl,
+// each adding or removing a single target, removals first, ordered by shape.
+// Steps must be performed in order.
+func (tm *targetMix) changes(esl ExporterSpecList) []func() error {
+	want := make(map[string]int)
+	var keys []string
+	for _, es := range esl {
+		key := tm.shape(es)
+		if _, ok := want[key]; !ok {
+			keys = append(keys, key)
+		}
+		want[key] += es.Count
+	}
+	running := make([]string, 0, len(tm.ports))
+	for key := range tm.ports {
+		running = append(running, key)
+	}
+	sort.Strings(running)
+	var removals, additions []func() error
+	for _, key := range running {
+		for i := want[key]; i < len(tm.ports[key]); i++ {
+			removals = append(removals, tm.remover(key))
+		}
+	}
+	for _, key := range keys {
+		for i := len(tm.ports[key]); i < want[key]; i++ {
+			additions = append(additions, tm.adder(key))
+		}
+	}
+	return append(removals, additions...)
+}
+
+// remover returns a step removing the most recent target of shape key.  A
+// target that fails to stop is still counted as running.
+func (tm *targetMix) remover(key string) func() error {
+	return func() error {
+		ports := tm.ports[key]
+		port := ports[len(ports)-1]
+		if _, err := stopExporters(tm.le, ExporterSpecList{tm.shapes[key]}, port); err != nil {
+			return err
+		}
+		tm.ports[key] = ports[:len(ports)-1]
+		return nil
+	}
+}
+
+// adder returns a step adding a target of shape key on the next free port.
+func (tm *targetMix) adder(key string) func() error {
+	return func() error {
+		port := tm.nextPort
+		tm.nextPort++
+		if _, err := startExporters(tm.le, ExporterSpecList{tm.shapes[key]}, port); err != nil {
+			return err
+		}
+		tm.ports[key] = append(tm.ports[key], port)
+		return nil
+	}
+}
+
+// startPhases runs the phases of put's config in the background from
+// startTime, changing the load targets of le, started by startExporters with
+// the config's Exporters and FirstPort, as each asks.  Reloads are left to
+// startReloads, given the phased config.  The wait function returned waits for
+// the phases to end and returns their records; cancel stops them early.
+func startPhases(ctx context.Context, put *promUnderTest, le loadgen.LoadExporter, startTime time.Time) (wait func() []phaseRecord, cancel context.CancelFunc) {
+	cfg := put.cfg
+	tm := newTargetMix(le, cfg.Exporters, cfg.FirstPort)
+	myctx, cancel := context.WithCancel(ctx)
+	var mtx sync.Mutex
+	var records []phaseRecord
+	var latencies sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer latencies.Wait()
+		phaseStart := startTime
+		for _, ps := range cfg.Phases {
+			phaseEnd := phaseStart.Add(ps.Duration)
+			log.Printf("phase %s: starting, %v long", ps.Name, ps.Duration)
+			ScenarioPhase.WithLabelValues(ps.Name).Set(1)
+			cancelRunIntervals := startRunIntervals(myctx, ps.RunIntervals)
+
+			var steps []func() error
+			if ps.Exporters != nil {
+				steps = tm.changes(ps.Exporters)
+			}
+			for i, step := range steps {
+				if ps.Ramp && !sleep(myctx, time.Until(phaseStart.Add(ps.Duration*time.Duration(i+1)/time.Duration(len(steps))))) {
+					break
+				}
+				if err := step(); err != nil {
+					log.Printf("phase %s: error changing load targets: %v", ps.Name, err)
+				}
+			}
+			if ps.Exporters != nil {
+				log.Printf("phase %s: %d load targets running", ps.Name, tm.targets())
+			}
+			sleep(myctx, time.Until(phaseEnd))
+			cancelRunIntervals()
+			ScenarioPhase.WithLabelValues(ps.Name).Set(0)
+			if myctx.Err() != nil {
+				return
+			}
+
+			mtx.Lock()
+			records = append(records, phaseRecord{Spec: ps, Start: phaseStart, End: time.Now(), Targets: tm.targets()})
+			idx := len(records) - 1
+			mtx.Unlock()
+			// Measure query latency over the phase as it ends.  This runs in
+			// the background so as not to delay the next phase, whose target
+			// changes may overlap the measurement.
+			latencies.Add(1)
+			go func(start time.Time) {
+				defer latencies.Done()
+				median, max := measureQueryLatency(myctx, put, start)
+				mtx.Lock()
+				records[idx].QueryLatencyMedian, records[idx].QueryLatencyMax = median, max
+				mtx.Unlock()
+			}(phaseStart)
+			phaseStart = phaseEnd
+		}
+	}()
+	return func() []phaseRecord {
+		<-done
+		mtx.Lock()
+		defer mtx.Unlock()
+		return records
+	}, cancel
+}
+
+// phaseResults returns the PhaseResults of put for the phases recorded,
+// given the scrapes it made and the resource samples taken during the run.
+func phaseResults(ctx context.Context, put *promUnderTest, records []phaseRecord, scrapes loadgen.ScrapeLedger,
+	resources []ResourceSample) []PhaseResult {
+	results := make([]PhaseResult, len(records))
+	for i, rec := range records {
+		pr := PhaseResult{
+			Name:               rec.Spec.Name,
+			Start:              rec.Start,
+			End:                rec.End,
+			Targets:            rec.Targets,
+			QueryLatencyMedian: rec.QueryLatencyMedian.Seconds(),
+			QueryLatencyMax:    rec.QueryLatencyMax.Seconds(),
+		}
+		pr.ScrapedSamples, pr.StoredSamples = storedSamples(ctx, put, rec.Start, rec.End, scrapes)
+		if pr.ScrapedSamples > 0 {
+			pr.Completeness = float64(pr.StoredSamples) / float64(pr.ScrapedSamples)
+		}
+		pr.SamplesPerSecond = float64(pr.ScrapedSamples) / rec.End.Sub(rec.Start).Seconds()
+		var window []ResourceSample
+		for _, rs := range resources {
+			if !rs.Time.Before(rec.Start) && !rs.Time.After(rec.End) {
+				window = append(window, rs)
+			}
+		}
+		pr.MaxRSSBytes, pr.CPUSeconds = maxRSS(window), cpuUsed(window)
+		results[i] = pr
+	}
+	return results
+}
+
+// reportPhases logs phase results side by side.
+func reportPhases(results []PhaseResult) {
+	rows := []struct {
+		name  string
+		value func(PhaseResult) string
+	}{
+		{"duration", func(p PhaseResult) string { return p.End.Sub(p.Start).Round(time.Second).String() }},
+		{"targets at end", func(p PhaseResult) string { return fmt.Sprint(p.Targets) }},
+		{"samples scraped", func(p PhaseResult) string { return fmt.Sprint(p.ScrapedSamples) }},
+		{"samples stored", func(p PhaseResult) string { return fmt.Sprint(p.StoredSamples) }},
+		{"completeness", func(p PhaseResult) string { return fmt.Sprintf("%.4f%%", 100*p.Completeness) }},
+		{"samples per second", func(p PhaseResult) string { return fmt.Sprintf("%.1f", p.SamplesPerSecond) }},
+		{"query latency median", func(p PhaseResult) string { return fmt.Sprintf("%.3fs", p.QueryLatencyMedian) }},
+		{"query latency max", func(p PhaseResult) string { return fmt.Sprintf("%.3fs", p.QueryLatencyMax) }},
+		{"max RSS bytes", func(p PhaseResult) string { return fmt.Sprint(p.MaxRSSBytes) }},
+		{"CPU seconds", func(p PhaseResult) string { return fmt.Sprintf("%.2f", p.CPUSeconds) }},
+	}
+	header := fmt.Sprintf("%-26s", "phase")
+	for _, p := range results {
+		header += fmt.Sprintf(" %-16s", p.Name)
+	}
+	log.Print(header)
+	for _, row := range rows {
+		line := fmt.Sprintf("%-26s", row.name)
+		for _, p := range results {
+			line += fmt.Sprintf(" %-16s", row.value(p))
+		}
+		log.Print(line)
+	}
+}
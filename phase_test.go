@@ -0,0 +1,198 @@
+package prombench
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ncabatoff/prombench/loadgen"
+)
+
+// fakeLoadExporter records the ports targets are added and removed on, in
+// order, as "+port" and "-port".  Removing a target on a port in failRemove
+// fails.
+type fakeLoadExporter struct {
+	ops        []string
+	failRemove map[int]bool
+}
+
+func (fle *fakeLoadExporter) AddTarget(port int, job string, exporter loadgen.Exporter) error {
+	fle.ops = append(fle.ops, fmt.Sprintf("+%d", port))
+	return nil
+}
+
+func (fle *fakeLoadExporter) RemoveTarget(port int) error {
+	if fle.failRemove[port] {
+		return fmt.Errorf("can't remove target on port %d", port)
+	}
+	fle.ops = append(fle.ops, fmt.Sprintf("-%d", port))
+	return nil
+}
+
+func (fle *fakeLoadExporter) Stop() ([]loadgen.InstanceSum, error) {
+	return nil, nil
+}
+
+func (fle *fakeLoadExporter) Scrapes() loadgen.ScrapeLedger {
+	return nil
+}
+
+// mustExporterSpecList parses v, or returns an empty list for "none".
+func mustExporterSpecList(t *testing.T, v string) ExporterSpecList {
+	esl := ExporterSpecList{}
+	if v == "none" {
+		return esl
+	}
+	if err := esl.Set(v); err != nil {
+		t.Fatal(err)
+	}
+	return esl
+}
+
+func TestTargetMixChanges(t *testing.T) {
+	fle := &fakeLoadExporter{}
+	tm := newTargetMix(fle, mustExporterSpecList(t, "inc:2,static:1"), 1000)
+	steps := []struct {
+		exporters string
+		ops       []string
+		targets   int
+	}{
+		// Removals come first, most recent target first, then additions on
+		// new ports.
+		{"static:2,counter:1", []string{"-1001", "-1000", "+1003", "+1004"}, 3},
+		{"static:2,counter:1", nil, 3},
+		// Specs of the same shape add up, and a different option makes a
+		// different shape.
+		{"static:1,static:2,inc:1:metrics=5", []string{"-1004", "+1005", "+1006"}, 4},
+		{"static:1", []string{"-1006", "-1005", "-1003"}, 1},
+		{"none", []string{"-1002"}, 0},
+	}
+	for _, step := range steps {
+		fle.ops = nil
+		for _, change := range tm.changes(mustExporterSpecList(t, step.exporters)) {
+			if err := change(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !reflect.DeepEqual(fle.ops, step.ops) {
+			t.Errorf("changing to %s did %v, want %v", step.exporters, fle.ops, step.ops)
+		}
+		if got := tm.targets(); got != step.targets {
+			t.Errorf("after changing to %s targets() = %d, want %d", step.exporters, got, step.targets)
+		}
+	}
+}
+
+func TestTargetMixRemoveFailure(t *testing.T) {
+	fle := &fakeLoadExporter{failRemove: map[int]bool{1001: true}}
+	tm := newTargetMix(fle, mustExporterSpecList(t, "inc:2"), 1000)
+	changes := tm.changes(mustExporterSpecList(t, "inc:1"))
+	if len(changes) != 1 {
+		t.Fatalf("changes() returned %d steps, want 1", len(changes))
+	}
+	if err := changes[0](); err == nil {
+		t.Fatalf("removing a target that fails to stop succeeded")
+	}
+	// The target that failed to stop is still running, so it's removed when
+	// next asked.
+	if got := tm.targets(); got != 2 {
+		t.Errorf("after a failed removal targets() = %d, want 2", got)
+	}
+	fle.failRemove = nil
+	for _, change := range tm.changes(mustExporterSpecList(t, "inc:1")) {
+		if err := change(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"-1001"}; !reflect.DeepEqual(fle.ops, want) {
+		t.Errorf("retrying the removal did %v, want %v", fle.ops, want)
+	}
+	if got := tm.targets(); got != 1 {
+		t.Errorf("after retrying the removal targets() = %d, want 1", got)
+	}
+}
+
+func TestConfigPhased(t *testing.T) {
+	cfg := Config{
+		ScrapeInterval: time.Second,
+		TestDuration:   time.Hour,
+		Reloads:        ReloadSpecList{{After: 5 * time.Second, Relabel: true}},
+		Phases: []PhaseSpec{
+			{Name: "a", Duration: time.Minute, ScrapeInterval: 2 * time.Second},
+			{Name: "b", Duration: 2 * time.Minute, Reloads: ReloadSpecList{{After: 10 * time.Second, Relabel: true}}},
+			{Name: "c", Duration: 3 * time.Minute, ScrapeInterval: 5 * time.Second},
+		},
+	}
+	got := cfg.phased()
+	if got.TestDuration != 6*time.Minute {
+		t.Errorf("phased().TestDuration = %v, want %v", got.TestDuration, 6*time.Minute)
+	}
+	// The first phase's scrape interval is the initial one; later ones are
+	// reloads at the start of their phase.
+	if got.ScrapeInterval != 2*time.Second {
+		t.Errorf("phased().ScrapeInterval = %v, want %v", got.ScrapeInterval, 2*time.Second)
+	}
+	wantReloads := ReloadSpecList{
+		{After: 5 * time.Second, Relabel: true},
+		{After: time.Minute + 10*time.Second, Relabel: true},
+		{After: 3 * time.Minute, ScrapeInterval: 5 * time.Second},
+	}
+	if !reflect.DeepEqual(got.Reloads, wantReloads) {
+		t.Errorf("phased().Reloads = %v, want %v", got.Reloads, wantReloads)
+	}
+	if len(cfg.Reloads) != 1 {
+		t.Errorf("phased() changed the reloads of the original config to %v", cfg.Reloads)
+	}
+
+	unphased := Config{TestDuration: time.Hour, ScrapeInterval: time.Second}
+	if got := unphased.phased(); !reflect.DeepEqual(got, unphased) {
+		t.Errorf("phased() without phases = %+v, want %+v", got, unphased)
+	}
+}
+
+func TestPhaseSpecUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		json string
+		want PhaseSpec
+	}{
+		{`{"name": "steady", "duration": "1m"}`, PhaseSpec{Name: "steady", Duration: time.Minute}},
+		{`{"name": "spike", "duration": "30s", "exporters": "inc:5", "ramp": true, "scrape-interval": "2s",
+		   "reload": "10s:relabel", "run-every": "5s:true"}`,
+			PhaseSpec{
+				Name:           "spike",
+				Duration:       30 * time.Second,
+				Exporters:      ExporterSpecList{{Exporter: ExporterInc, Count: 5}},
+				Ramp:           true,
+				ScrapeInterval: 2 * time.Second,
+				Reloads:        ReloadSpecList{{After: 10 * time.Second, Relabel: true}},
+				RunIntervals:   RunIntervalSpecList{{Command: "true", Interval: 5 * time.Second}},
+			}},
+		// An empty mix, unlike a missing one, removes every target.
+		{`{"name": "down", "duration": "1m", "exporters": "none", "ramp": true}`,
+			PhaseSpec{Name: "down", Duration: time.Minute, Exporters: ExporterSpecList{}, Ramp: true}},
+		{`{"name": "down", "duration": "1m", "exporters": ""}`,
+			PhaseSpec{Name: "down", Duration: time.Minute, Exporters: ExporterSpecList{}}},
+	}
+	for _, tt := range tests {
+		var ps PhaseSpec
+		if err := json.Unmarshal([]byte(tt.json), &ps); err != nil {
+			t.Errorf("unmarshalling %s: %v", tt.json, err)
+		} else if !reflect.DeepEqual(ps, tt.want) {
+			t.Errorf("unmarshalling %s = %+v, want %+v", tt.json, ps, tt.want)
+		}
+	}
+
+	for _, bad := range []string{
+		`{"name": "x"}`,
+		`{"name": "x", "duration": "1m", "exporters": "nosuchkind:1"}`,
+		`{"name": "x", "duration": "1m", "scrape-interval": "0s"}`,
+		`{"name": "x", "duration": "1m", "reload": "soon"}`,
+	} {
+		var ps PhaseSpec
+		if err := json.Unmarshal([]byte(bad), &ps); err == nil {
+			t.Errorf("unmarshalling %s = %+v, want error", bad, ps)
+		}
+	}
+}
@@ -2,17 +2,23 @@ package prombench
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/ncabatoff/prombench/harness"
 	"github.com/ncabatoff/prombench/loadgen"
-	api "github.com/prometheus/client_golang/api/prometheus"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
+	"io/ioutil"
 	"log"
+	"math"
 	"net"
+	"net/http"
+	neturl "net/url"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,6 +30,54 @@ const (
 	ExporterStatic
 	ExporterRandCyclic
 	ExporterOscillate
+	ExporterCounter
+	ExporterHistogram
+	ExporterSummary
+	ExporterChurn
+)
+
+// loadExporterKindNames are the names used for each LoadExporterKind in exporter specs.
+var loadExporterKindNames = []string{
+	ExporterInc:        "inc",
+	ExporterStatic:     "static",
+	ExporterRandCyclic: "randcyclic",
+	ExporterOscillate:  "oscillate",
+	ExporterCounter:    "counter",
+	ExporterHistogram:  "histogram",
+	ExporterSummary:    "summary",
+	ExporterChurn:      "churn",
+}
+
+// Name returns the name by which k is selected in an exporter spec.
+func (k LoadExporterKind) Name() string {
+	if k < 0 || int(k) >= len(loadExporterKindNames) {
+		return k.String()
+	}
+	return loadExporterKindNames[k]
+}
+
+// ParseLoadExporterKind returns the LoadExporterKind whose Name is name.
+func ParseLoadExporterKind(name string) (LoadExporterKind, error) {
+	for i, n := range loadExporterKindNames {
+		if n == name {
+			return LoadExporterKind(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid exporter name '%s'", name)
+}
+
+// Defaults used for exporter spec options that aren't given explicitly.
+const (
+	DefaultExporterMetrics  = 100
+	DefaultExporterLabels   = 100
+	DefaultExporterMaxValue = 100000
+	// DefaultExporterObservations is the number of observations made per scrape.
+	DefaultExporterObservations = 10
+	DefaultExporterDistribution = "exp"
+	// DefaultExporterChurnFraction is the fraction of label values replaced each churn.
+	DefaultExporterChurnFraction = 0.1
+	// DefaultExporterChurnEvery is the number of scrapes between churns.
+	DefaultExporterChurnEvery = 10
 )
 
 var (
@@ -40,16 +94,59 @@ var (
 		},
 		[]string{"run_name", "query"},
 	)
+
+	ExporterTargets *prometheus.GaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prombench",
+			Subsystem: "load",
+			Name:      "targets",
+			Help:      "number of load exporter targets started, by exporter shape",
+		},
+		[]string{"exporter", "metrics", "labels"},
+	)
+
+	ExporterSeries *prometheus.GaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prombench",
+			Subsystem: "load",
+			Name:      "series",
+			Help:      "number of series exposed by load exporter targets, by exporter shape",
+		},
+		[]string{"exporter", "metrics", "labels"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(QueryTime)
+	prometheus.MustRegister(ExporterTargets)
+	prometheus.MustRegister(ExporterSeries)
 }
 
 type (
+	// ExporterSpec describes a group of identically shaped load exporters.
+	// Zero-valued shape fields mean the corresponding default is used.
 	ExporterSpec struct {
 		Exporter LoadExporterKind
 		Count    int
+		// Metrics is the number of metric names each exporter exposes.
+		Metrics int
+		// Labels is the number of label values exposed for each metric name.
+		Labels int
+		// MaxValue is the exclusive upper bound on randcyclic values.
+		MaxValue int
+		// ResetEvery is the number of scrapes between counter resets; zero means never.
+		ResetEvery int
+		// Buckets are the histogram bucket upper bounds, excluding +Inf.
+		Buckets []float64
+		// Distribution names the loadgen.Distributions entry histogram and
+		// summary observations are drawn from.
+		Distribution string
+		// Observations is the number of histogram or summary observations per scrape.
+		Observations int
+		// ChurnFraction is the fraction of label values a churn exporter replaces at a time.
+		ChurnFraction float64
+		// ChurnEvery is the number of scrapes between churn exporter replacements.
+		ChurnEvery int
 	}
 	ExporterSpecList []ExporterSpec
 	RunIntervalSpec  struct {
@@ -71,15 +168,208 @@ type (
 		RunIntervals            RunIntervalSpecList
 		MaxDeltaRatio           float64
 		MaxQueryRetries         int
-		AdaptiveInterval        time.Duration
+		CheckInterval           time.Duration
 		PrombenchListenAddress  string
 		PrometheusListenAddress string
+		// HTTPSdListenAddress is where the run serves its targets for
+		// http_sd_configs when Discovery is DiscoveryHTTP.  Runs in the same
+		// process at the same time need different addresses.
+		HTTPSdListenAddress string
+		// LoadExporterPath, if set, is the load_exporter binary used to serve
+		// targets out of process, spread over at most LoadExporterWorkers
+		// processes, or one per target if LoadExporterWorkers is zero.
+		LoadExporterPath    string
+		LoadExporterWorkers int
+		// Multiplex, if not MultiplexNone, serves all targets from a single
+		// listener on FirstPort.  It can't be combined with LoadExporterPath.
+		Multiplex loadgen.MultiplexMode
+		// Discovery selects how Prometheus discovers the load targets.
+		Discovery loadgen.DiscoveryMode
+		// AdaptiveInterval, if nonzero, is how often the search for the
+		// largest load Prometheus sustains checks whether it's overloaded,
+		// and AdaptiveStability how long a load level must go without
+		// overloading it to count as sustained.
+		AdaptiveInterval  time.Duration
+		AdaptiveStability time.Duration
+		// HealthSignals show when Prometheus is overloaded during the
+		// adaptive search; any one tripping is enough.  If empty, signals
+		// suited to the Prometheus version are used.
+		HealthSignals HealthSignalList
+		// Queries, if set, are issued from QueryConcurrency workers while the
+		// load runs, at no more than QueryRate queries per second overall if
+		// that's nonzero, to measure query performance under ingestion.
+		Queries          QuerySpecList
+		QueryConcurrency int
+		QueryRate        float64
+		// Phases, if set, make up the test: TestDuration is their total, and
+		// their reloads are added to Reloads.  Exporters are the targets
+		// started before the first phase, and may be empty.
+		Phases []PhaseSpec
+		// PrometheusConfigTemplate, if set, is the path of a Go template for
+		// prometheus.yml, see harness.DefaultConfigTemplate.
+		PrometheusConfigTemplate string
+		// ExternalPrometheusURL, if set, is the URL of a Prometheus managed by
+		// someone else.  Rather than starting Prometheus, prombench serves
+		// exporters for it to discover, via sd_config files written to
+		// SdConfigDir or HTTP SD, and verifies through this URL.
+		ExternalPrometheusURL string
+		SdConfigDir           string
+		// TargetHost is the host exporters listen on and are registered as, by
+		// default localhost.
+		TargetHost string
+		// PrometheusUsername and PrometheusPassword, or PrometheusBearerToken,
+		// are credentials sent with queries to Prometheus.
+		PrometheusUsername    string
+		PrometheusPassword    string
+		PrometheusBearerToken string
+		// CrashAfter, if nonzero, is how long into the test to SIGKILL
+		// Prometheus and restart it on the same test directory.
+		CrashAfter time.Duration
+		// ResourceInterval, if nonzero, is how often to sample the resource
+		// usage of Prometheus from /proc.
+		ResourceInterval time.Duration
+		// StorageInterval, if nonzero, is how often to measure the size of
+		// the Prometheus data directory.
+		StorageInterval time.Duration
+		// Reloads are config changes to make during the test, each followed by
+		// a reload using ReloadMethod.
+		Reloads      ReloadSpecList
+		ReloadMethod harness.ReloadMethod
+		// ComparePrometheusPath, if set, is a second Prometheus binary to run
+		// alongside PrometheusPath, listening on ComparePrometheusListenAddress
+		// and scraping the same targets, so that the two can be compared.
+		ComparePrometheusPath          string
+		ComparePrometheusListenAddress string
+
+		// prometheusName identifies which Prometheus a copy of the Config is
+		// for when comparing two, and is empty otherwise.
+		prometheusName string
 	}
 )
 
-// TODO check for errors when the Config is created
+// PrometheusInstance returns the address at which to reach Prometheus.
 func (c Config) PrometheusInstance() (string, error) {
-	host, port, err := net.SplitHostPort(c.PrometheusListenAddress)
+	return listenInstance(c.PrometheusListenAddress)
+}
+
+// Validate returns an error if c is incomplete or asks for options that can't
+// be combined.
+func (c Config) Validate() error {
+	if len(c.Phases) > 0 {
+		if err := c.validatePhases(); err != nil {
+			return err
+		}
+		c = c.phased()
+	}
+	if c.TestDirectory == "" {
+		return fmt.Errorf("no test directory given")
+	}
+	if c.ScrapeInterval <= 0 {
+		return fmt.Errorf("scrape interval must be positive, not %v", c.ScrapeInterval)
+	}
+	if c.TestDuration <= 0 {
+		return fmt.Errorf("test duration must be positive, not %v", c.TestDuration)
+	}
+	if c.MaxDeltaRatio < 0 {
+		return fmt.Errorf("max delta ratio must not be negative, not %g", c.MaxDeltaRatio)
+	}
+	if c.MaxQueryRetries < 0 {
+		return fmt.Errorf("max query retries must not be negative, not %d", c.MaxQueryRetries)
+	}
+	if len(c.Exporters) == 0 && !c.hasPhaseExporters() {
+		return fmt.Errorf("no exporters given")
+	}
+	for _, es := range c.Exporters {
+		if _, err := NewExporter(es); err != nil {
+			return fmt.Errorf("bad exporter spec '%s': %v", es.String(), err)
+		}
+	}
+	if _, err := c.PrombenchInstance(); err != nil {
+		return fmt.Errorf("bad prombench listen address %q: %v", c.PrombenchListenAddress, err)
+	}
+	if c.Discovery == loadgen.DiscoveryHTTP {
+		if _, err := c.HTTPSdInstance(); err != nil {
+			return fmt.Errorf("bad http_sd_configs listen address %q: %v", c.HTTPSdListenAddress, err)
+		}
+		if c.HTTPSdListenAddress == c.PrombenchListenAddress {
+			return fmt.Errorf("targets for http_sd_configs can't be served on the prombench listen address %q", c.PrombenchListenAddress)
+		}
+	}
+	if c.CrashAfter >= c.TestDuration {
+		return fmt.Errorf("crash after %v is beyond the test duration %v", c.CrashAfter, c.TestDuration)
+	}
+	for _, rs := range c.Reloads {
+		if rs.After >= c.TestDuration {
+			return fmt.Errorf("reload after %v is beyond the test duration %v", rs.After, c.TestDuration)
+		}
+	}
+	if c.AdaptiveInterval > 0 && c.AdaptiveStability < c.AdaptiveInterval {
+		return fmt.Errorf("adaptive stability window %v is shorter than the adaptive interval %v", c.AdaptiveStability, c.AdaptiveInterval)
+	}
+	if len(c.Queries) > 0 && c.QueryConcurrency <= 0 {
+		return fmt.Errorf("query concurrency must be positive, not %d", c.QueryConcurrency)
+	}
+	if c.QueryRate < 0 {
+		return fmt.Errorf("query rate must not be negative, not %g", c.QueryRate)
+	}
+	if !(c.QueryRate <= maxQueryRate) {
+		return fmt.Errorf("query rate must be at most %g, not %g", maxQueryRate, c.QueryRate)
+	}
+	for _, hs := range c.HealthSignals {
+		if hs.Name == "" || strings.TrimSpace(hs.Query) == "" {
+			return fmt.Errorf("health signal %q needs a name and a query", hs.String())
+		}
+	}
+	if c.Multiplex != loadgen.MultiplexNone && c.LoadExporterPath != "" {
+		return fmt.Errorf("multiplexing targets isn't supported with an external load exporter")
+	}
+	if _, err := loadgen.ParseDiscoveryMode(c.Discovery.String()); err != nil {
+		return err
+	}
+
+	if c.ExternalPrometheusURL != "" {
+		switch {
+		case c.CrashAfter > 0:
+			return fmt.Errorf("can't crash an external Prometheus")
+		case len(c.Reloads) > 0:
+			return fmt.Errorf("can't reload the config of an external Prometheus")
+		case c.ComparePrometheusPath != "":
+			return fmt.Errorf("can't compare an external Prometheus")
+		case c.Discovery == loadgen.DiscoveryStatic:
+			return fmt.Errorf("static discovery needs prombench to manage the Prometheus config")
+		case c.Discovery == loadgen.DiscoveryFile && c.SdConfigDir == "":
+			return fmt.Errorf("file discovery for an external Prometheus needs an sd_config directory")
+		}
+		return nil
+	}
+
+	if c.PrometheusPath == "" {
+		return fmt.Errorf("no Prometheus binary given")
+	}
+	if _, err := c.PrometheusInstance(); err != nil {
+		return fmt.Errorf("bad Prometheus listen address %q: %v", c.PrometheusListenAddress, err)
+	}
+	if c.ComparePrometheusPath != "" {
+		switch {
+		case c.CrashAfter > 0:
+			return fmt.Errorf("can't crash Prometheus while comparing two")
+		case len(c.Reloads) > 0:
+			return fmt.Errorf("can't reload the config of Prometheus while comparing two")
+		}
+		if _, err := listenInstance(c.ComparePrometheusListenAddress); err != nil {
+			return fmt.Errorf("bad listen address %q for the Prometheus to compare: %v", c.ComparePrometheusListenAddress, err)
+		}
+		if c.ComparePrometheusListenAddress == c.PrometheusListenAddress {
+			return fmt.Errorf("the Prometheus servers compared can't both listen on %q", c.PrometheusListenAddress)
+		}
+	}
+	return nil
+}
+
+// listenInstance returns the address at which to reach a server listening on
+// listenAddress.
+func listenInstance(listenAddress string) (string, error) {
+	host, port, err := net.SplitHostPort(listenAddress)
 	if err != nil {
 		return "", err
 	}
@@ -146,8 +436,23 @@ func (esl *ExporterSpecList) Get() interface{} {
 	return *esl
 }
 
+// splitExporterSpecs splits a comma-separated exporter spec list.  Since the
+// options of a single spec are also comma-separated, elements that look like
+// an option (key=value without a colon) are joined back onto the preceding spec.
+func splitExporterSpecs(v string) []string {
+	var specs []string
+	for _, s := range strings.Split(v, ",") {
+		if len(specs) > 0 && !strings.Contains(s, ":") && strings.Contains(s, "=") {
+			specs[len(specs)-1] += "," + s
+		} else {
+			specs = append(specs, s)
+		}
+	}
+	return specs
+}
+
 func (esl *ExporterSpecList) Set(v string) error {
-	ss := strings.Split(v, ",")
+	ss := splitExporterSpecs(v)
 	*esl = make([]ExporterSpec, len(ss))
 	for i, s := range ss {
 		if err := (*esl)[i].Set(s); err != nil {
@@ -157,8 +462,115 @@ func (esl *ExporterSpecList) Set(v string) error {
 	return nil
 }
 
+// GetMetrics returns the number of metric names, applying the default if unset.
+func (e ExporterSpec) GetMetrics() int {
+	if e.Metrics > 0 {
+		return e.Metrics
+	}
+	return DefaultExporterMetrics
+}
+
+// GetLabels returns the number of label values per metric, applying the default if unset.
+func (e ExporterSpec) GetLabels() int {
+	if e.Labels > 0 {
+		return e.Labels
+	}
+	return DefaultExporterLabels
+}
+
+// GetMaxValue returns the randcyclic value bound, applying the default if unset.
+func (e ExporterSpec) GetMaxValue() int {
+	if e.MaxValue > 0 {
+		return e.MaxValue
+	}
+	return DefaultExporterMaxValue
+}
+
+// GetBuckets returns the histogram bucket bounds, applying the default if unset.
+func (e ExporterSpec) GetBuckets() []float64 {
+	if len(e.Buckets) > 0 {
+		return e.Buckets
+	}
+	return prometheus.DefBuckets
+}
+
+// GetDistribution returns the observation distribution name, applying the default if unset.
+func (e ExporterSpec) GetDistribution() string {
+	if e.Distribution != "" {
+		return e.Distribution
+	}
+	return DefaultExporterDistribution
+}
+
+// GetObservations returns the observations per scrape, applying the default if unset.
+func (e ExporterSpec) GetObservations() int {
+	if e.Observations > 0 {
+		return e.Observations
+	}
+	return DefaultExporterObservations
+}
+
+// GetChurnFraction returns the churn fraction, applying the default if unset.
+func (e ExporterSpec) GetChurnFraction() float64 {
+	if e.ChurnFraction > 0 {
+		return e.ChurnFraction
+	}
+	return DefaultExporterChurnFraction
+}
+
+// GetChurnEvery returns the scrapes between churns, applying the default if unset.
+func (e ExporterSpec) GetChurnEvery() int {
+	if e.ChurnEvery > 0 {
+		return e.ChurnEvery
+	}
+	return DefaultExporterChurnEvery
+}
+
+// options returns the key=value options of e that differ from the defaults.
+func (e *ExporterSpec) options() []string {
+	var opts []string
+	if m := e.GetMetrics(); m != DefaultExporterMetrics {
+		opts = append(opts, fmt.Sprintf("metrics=%d", m))
+	}
+	if l := e.GetLabels(); l != DefaultExporterLabels {
+		opts = append(opts, fmt.Sprintf("labels=%d", l))
+	}
+	if m := e.GetMaxValue(); m != DefaultExporterMaxValue {
+		opts = append(opts, fmt.Sprintf("max=%d", m))
+	}
+	if e.ResetEvery > 0 {
+		opts = append(opts, fmt.Sprintf("reset=%d", e.ResetEvery))
+	}
+	if len(e.Buckets) > 0 {
+		bs := make([]string, len(e.Buckets))
+		for i, b := range e.Buckets {
+			bs[i] = strconv.FormatFloat(b, 'g', -1, 64)
+		}
+		opts = append(opts, "buckets="+strings.Join(bs, ";"))
+	}
+	if d := e.GetDistribution(); d != DefaultExporterDistribution {
+		opts = append(opts, "dist="+d)
+	}
+	if o := e.GetObservations(); o != DefaultExporterObservations {
+		opts = append(opts, fmt.Sprintf("obs=%d", o))
+	}
+	if e.Exporter == ExporterChurn {
+		if f := e.GetChurnFraction(); f != DefaultExporterChurnFraction {
+			opts = append(opts, "fraction="+strconv.FormatFloat(f, 'g', -1, 64))
+		}
+		if n := e.GetChurnEvery(); n != DefaultExporterChurnEvery {
+			opts = append(opts, fmt.Sprintf("every=%d", n))
+		}
+	}
+	return opts
+}
+
 func (e *ExporterSpec) String() string {
-	return fmt.Sprintf("%s:%d", e.Exporter, e.Count)
+	s := fmt.Sprintf("%s:%d", e.Exporter.Name(), e.Count)
+	if opts := e.options(); len(opts) > 0 {
+		s += ":" + strings.Join(opts, ",")
+	}
+	return s
 }
 
 func (e *ExporterSpec) Get() interface{} {
@@ -166,55 +578,176 @@ func (e *ExporterSpec) Get() interface{} {
 }
 
 func (e *ExporterSpec) Set(v string) error {
-	pieces := strings.SplitN(v, ":", 2)
-	if len(pieces) != 2 {
-		return fmt.Errorf("bad exporter spec '%s': must be of the form 'name:count'", v)
-	}
-
-	switch pieces[0] {
-	case "inc":
-		e.Exporter = ExporterInc
-	case "static":
-		e.Exporter = ExporterStatic
-	case "randcyclic":
-		e.Exporter = ExporterRandCyclic
-	case "oscillate":
-		e.Exporter = ExporterOscillate
-	default:
-		return fmt.Errorf("invalid exporter name '%s'", pieces[0])
+	pieces := strings.SplitN(v, ":", 3)
+	if len(pieces) < 2 {
+		return fmt.Errorf("bad exporter spec '%s': must be of the form 'name:count[:key=value,...]'", v)
 	}
+
+	kind, err := ParseLoadExporterKind(pieces[0])
+	if err != nil {
+		return err
+	}
+	*e = ExporterSpec{Exporter: kind}
 	if c, err := strconv.Atoi(pieces[1]); err != nil || c <= 0 {
 		return fmt.Errorf("invalid exporter count '%s'", pieces[1])
 	} else {
 		e.Count = c
 	}
+	if len(pieces) == 3 {
+		for _, opt := range strings.Split(pieces[2], ",") {
+			if err := e.setOption(opt); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
+// setOption parses a single key=value exporter option.
+func (e *ExporterSpec) setOption(opt string) error {
+	kv := strings.SplitN(opt, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("bad exporter option '%s': must be of the form 'key=value'", opt)
+	}
+	key, val := kv[0], kv[1]
+	onlyFor := func(kinds ...LoadExporterKind) error {
+		names := make([]string, len(kinds))
+		for i, k := range kinds {
+			if e.Exporter == k {
+				return nil
+			}
+			names[i] = k.Name()
+		}
+		return fmt.Errorf("exporter option '%s' only applies to %s exporters", key, strings.Join(names, " and "))
+	}
+	intval := func() (int, error) {
+		n, err := strconv.Atoi(val)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid value '%s' for exporter option '%s'", val, key)
+		}
+		return n, nil
+	}
+
+	var err error
+	switch key {
+	case "metrics":
+		e.Metrics, err = intval()
+	case "labels":
+		e.Labels, err = intval()
+	case "max":
+		if err = onlyFor(ExporterRandCyclic); err == nil {
+			e.MaxValue, err = intval()
+		}
+	case "reset":
+		if err = onlyFor(ExporterCounter); err == nil {
+			e.ResetEvery, err = intval()
+		}
+	case "obs":
+		if err = onlyFor(ExporterHistogram, ExporterSummary); err == nil {
+			e.Observations, err = intval()
+		}
+	case "dist":
+		if err = onlyFor(ExporterHistogram, ExporterSummary); err == nil {
+			if _, ok := loadgen.Distributions[val]; ok {
+				e.Distribution = val
+			} else {
+				err = fmt.Errorf("invalid distribution '%s'", val)
+			}
+		}
+	case "buckets":
+		if err = onlyFor(ExporterHistogram); err == nil {
+			e.Buckets, err = parseBuckets(val)
+		}
+	case "fraction":
+		if err = onlyFor(ExporterChurn); err == nil {
+			f, perr := strconv.ParseFloat(val, 64)
+			if perr != nil || f <= 0 || f > 1 {
+				err = fmt.Errorf("invalid value '%s' for exporter option '%s': must be in (0,1]", val, key)
+			} else {
+				e.ChurnFraction = f
+			}
+		}
+	case "every":
+		if err = onlyFor(ExporterChurn); err == nil {
+			e.ChurnEvery, err = intval()
+		}
+	default:
+		err = fmt.Errorf("invalid exporter option '%s'", key)
+	}
+	return err
+}
+
+// parseBuckets parses a semicolon-separated list of increasing histogram bucket
+// upper bounds.
+func parseBuckets(v string) ([]float64, error) {
+	var buckets []float64
+	for _, s := range strings.Split(v, ";") {
+		b, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket '%s': %v", s, err)
+		}
+		if len(buckets) > 0 && b <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("buckets '%s' must be in increasing order", v)
+		}
+		if math.IsInf(b, 1) {
+			return nil, fmt.Errorf("buckets '%s' must not include +Inf", v)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
 type extraPrometheusArgsCollector struct {
 	descs   []*prometheus.Desc
 	metrics []prometheus.Metric
 }
 
-func newExtraPrometheusArgsCollector(args []string, retention time.Duration) *extraPrometheusArgsCollector {
+// isFlagArg returns whether arg is a flag rather than a value, which may be a
+// negative number.
+func isFlagArg(arg string) bool {
+	return strings.HasPrefix(arg, "-") && len(strings.TrimLeft(arg, "-")) > 0 &&
+		strings.IndexAny(arg[1:2], "0123456789.") != 0
+}
+
+// flagValues returns the value of each flag in args given as --flag=value or
+// --flag value, by flag name without dashes, in order.  Boolean flags given
+// without a value are omitted.
+func flagValues(args []string) [][2]string {
+	var fvs [][2]string
+	for i := 0; i < len(args); i++ {
+		if !isFlagArg(args[i]) {
+			continue
+		}
+		name := strings.TrimLeft(args[i], "-")
+		if eq := strings.Index(name, "="); eq >= 0 {
+			fvs = append(fvs, [2]string{name[:eq], name[eq+1:]})
+		} else if i+1 < len(args) && !isFlagArg(args[i+1]) {
+			fvs = append(fvs, [2]string{name, args[i+1]})
+			i++
+		}
+	}
+	return fvs
+}
+
+func newExtraPrometheusArgsCollector(args []string, retentionFlag string, retention time.Duration, labels prometheus.Labels) *extraPrometheusArgsCollector {
 	epac := extraPrometheusArgsCollector{}
-	for i := 0; i < len(args)-1; i += 2 {
-		val, err := strconv.Atoi(args[i+1])
+	for _, fv := range flagValues(args) {
+		val, err := strconv.Atoi(fv[1])
 		if err == nil {
-			nodashes := strings.TrimLeft(args[i], "-")
+			nodashes := fv[0]
 			name := "prometheus_arg_" + strings.Replace(strings.Replace(nodashes, "-", "_", -1), ".", "_", -1)
 			help := fmt.Sprintf("value of prometheus -%s option", nodashes)
-			desc := prometheus.NewDesc(name, help, nil, nil)
+			desc := prometheus.NewDesc(name, help, nil, labels)
 			epac.descs = append(epac.descs, desc)
 			epac.metrics = append(epac.metrics, prometheus.MustNewConstMetric(desc,
 				prometheus.GaugeValue, float64(val)))
 		}
 	}
 	if retention > 0 {
-		nodashes := "storage.local.retention"
+		nodashes := retentionFlag
 		name := "prometheus_arg_" + strings.Replace(strings.Replace(nodashes, "-", "_", -1), ".", "_", -1) + "_seconds"
 		help := fmt.Sprintf("value of prometheus -%s option in seconds", nodashes)
-		desc := prometheus.NewDesc(name, help, nil, nil)
+		desc := prometheus.NewDesc(name, help, nil, labels)
 		epac.descs = append(epac.descs, desc)
 		epac.metrics = append(epac.metrics, prometheus.MustNewConstMetric(desc,
 			prometheus.GaugeValue, retention.Seconds()))
@@ -237,59 +770,47 @@ func (epac *extraPrometheusArgsCollector) Collect(ch chan<- prometheus.Metric) {
 	}
 }
 
-func startExportersAdaptive(ctx context.Context, le loadgen.LoadExporter, firstPort int, cfg Config) context.CancelFunc {
-	instance, err := cfg.PrometheusInstance()
-	if err != nil {
-		log.Fatalf("can't construct query URL: %v", err)
-	}
-	queryUrl := "http://" + instance
+var (
+	// argsCollectors are the registered extraPrometheusArgsCollectors, by
+	// the name of the Prometheus they describe.
+	argsCollectorsMtx sync.Mutex
+	argsCollectors    = make(map[string]prometheus.Collector)
+)
 
-	myctx, cancel := context.WithCancel(ctx)
-	go func() {
-		query := fmt.Sprintf(`prometheus_target_interval_length_seconds{quantile="0.99", interval="%s"}`,
-			cfg.ScrapeInterval)
-		ticker := time.NewTicker(cfg.AdaptiveInterval)
-		done := myctx.Done()
-		for {
-			select {
-			case <-done:
-				ticker.Stop()
-				cancel()
-				break
-			case <-ticker.C:
-				vect := queryPrometheusVector(myctx, queryUrl, query)
-				if len(vect) != 1 {
-					log.Printf("error querying scrape interval: %d results returned", len(vect))
-					continue
-				}
-				secs := time.Duration(float64(time.Second) * float64(vect[0].Value))
-				deltaSecs := secs - cfg.ScrapeInterval
-				if deltaSecs < cfg.ScrapeInterval/20 {
-					log.Printf("99th percentile of scrape interval %s within 5%% (delta %s), adding targets", cfg.ScrapeInterval, deltaSecs)
-					firstPort += startExporters(le, cfg.Exporters, firstPort)
-				}
-			}
-		}
-	}()
-	return cancel
+// registerArgsCollector registers c for the Prometheus called name, replacing
+// the collector registered by any earlier run in this process.
+func registerArgsCollector(name string, c prometheus.Collector) {
+	argsCollectorsMtx.Lock()
+	defer argsCollectorsMtx.Unlock()
+	if old, ok := argsCollectors[name]; ok {
+		prometheus.Unregister(old)
+	}
+	argsCollectors[name] = c
+	if err := prometheus.Register(c); err != nil {
+		log.Printf("unable to register metrics of Prometheus args: %v", err)
+	}
 }
 
-func getExtraArgs(cfg Config) []string {
-	extraArgs := append([]string{}, cfg.ExtraArgs...)
-	if cfg.TestRetention > 0 {
-		extraArgs = append(extraArgs, "-storage.local.retention",
-			fmt.Sprintf("%ds", int(cfg.TestRetention.Seconds())))
-	}
-	if len(extraArgs) > 0 {
-		prometheus.MustRegister(newExtraPrometheusArgsCollector(extraArgs, cfg.TestRetention))
+func getExtraArgs(cfg Config, version harness.PrometheusVersion, opts harness.PrometheusOptions) []string {
+	extraArgs := version.TranslateArgs(cfg.ExtraArgs)
+	opts.Retention = cfg.TestRetention
+	opts.EnableAdminAPI = true
+	extraArgs = append(extraArgs, version.Args(opts)...)
+	var labels prometheus.Labels
+	if cfg.prometheusName != "" {
+		labels = prometheus.Labels{"prometheus": cfg.prometheusName}
 	}
-	return append(extraArgs, "-web.listen-address", cfg.PrometheusListenAddress)
+	registerArgsCollector(cfg.prometheusName, newExtraPrometheusArgsCollector(extraArgs, version.RetentionFlag(), cfg.TestRetention, labels))
+	return append(extraArgs, version.Args(harness.PrometheusOptions{ListenAddress: cfg.PrometheusListenAddress})...)
 }
 
-func waitForPrometheus(ctx context.Context, instance string) bool {
-	queryUrl := "http://" + instance
-	// TODO make timeout configurable
-	endTime := time.Now().Add(time.Second * 10)
+// startTimeout is how long to wait for Prometheus to respond after starting.
+const startTimeout = 10 * time.Second
+
+// waitForPrometheus waits up to timeout for query to return a positive value,
+// showing that Prometheus is up.
+func waitForPrometheus(ctx context.Context, pc promClient, query string, timeout time.Duration) bool {
+	endTime := time.Now().Add(timeout)
 	for {
 		timeLeft := endTime.Sub(time.Now())
 		if timeLeft < 0 {
@@ -298,8 +819,7 @@ func waitForPrometheus(ctx context.Context, instance string) bool {
 		}
 
 		myctx, cancel := context.WithTimeout(ctx, timeLeft)
-		query := fmt.Sprintf(`up{job="prometheus", instance="%s"}`, instance)
-		vect := queryPrometheusVector(myctx, queryUrl, query)
+		vect := queryPrometheusVector(myctx, pc, query)
 		cancel()
 
 		if len(vect) > 0 {
@@ -309,87 +829,447 @@ func waitForPrometheus(ctx context.Context, instance string) bool {
 			}
 		}
 
-		time.Sleep(500 * time.Millisecond)
+		if !sleep(ctx, 500*time.Millisecond) {
+			return false
+		}
 	}
 }
 
-func Run(cfg Config) {
-	instance, err := cfg.PrometheusInstance()
+// promUnderTest is a Prometheus being benchmarked.
+type promUnderTest struct {
+	// cfg is the run's Config, with the settings that differ between the
+	// Prometheus servers being compared filled in for this one.
+	cfg Config
+	// h manages Prometheus, and is nil if Prometheus is external.
+	h        *harness.Harness
+	version  harness.PrometheusVersion
+	instance string
+	client   promClient
+	promArgs []string
+	stop     func()
+
+	stopSampling func() []ResourceSample
+	stopStorage  func() map[string]int64
+}
+
+// stopSamplers stops sampling the resource usage and storage of put, returning
+// the samples taken.  Later calls return nothing.
+func (put *promUnderTest) stopSamplers() ([]ResourceSample, map[string]int64) {
+	resources, storage := put.stopSampling(), put.stopStorage()
+	put.stopSampling = func() []ResourceSample { return nil }
+	put.stopStorage = func() map[string]int64 { return nil }
+	return resources, storage
+}
+
+// startPrometheus starts the Prometheus described by cfg in its own harness,
+// along with sampling of its resource usage and storage.  The promUnderTest
+// returned should be stopped even if there's an error, since Prometheus may
+// have started without answering queries.
+func startPrometheus(ctx context.Context, cfg Config) (*promUnderTest, error) {
+	put := &promUnderTest{
+		cfg:          cfg,
+		stop:         func() {},
+		stopSampling: func() []ResourceSample { return nil },
+		stopStorage:  func() map[string]int64 { return nil },
+	}
+	var err error
+	put.instance, err = cfg.PrometheusInstance()
+	if err != nil {
+		return put, fmt.Errorf("can't construct query URL: %v", err)
+	}
+	put.client = promClient{url: "http://" + put.instance, transport: newQueryTransport(cfg)}
+
+	sdcfg, err := testSdConfig(cfg)
+	if err != nil {
+		return put, fmt.Errorf("can't construct discovery config: %v", err)
+	}
+	var cfgTemplate []byte
+	if cfg.PrometheusConfigTemplate != "" {
+		if cfgTemplate, err = ioutil.ReadFile(cfg.PrometheusConfigTemplate); err != nil {
+			return put, fmt.Errorf("can't read Prometheus config template: %v", err)
+		}
+	}
+	put.h, err = harness.NewHarness(cfg.TestDirectory, cfg.RmTestDirectory, harness.ConfigParams{
+		Template:          string(cfgTemplate),
+		ScrapeInterval:    cfg.ScrapeInterval,
+		PrombenchAddress:  cfg.PrombenchListenAddress,
+		PrometheusAddress: put.instance,
+		TestSdConfig:      sdcfg,
+		Scraper:           cfg.prometheusName,
+	})
+	if err != nil {
+		return put, err
+	}
+
+	put.h.SetReloadMethod(cfg.ReloadMethod)
+
+	var output string
+	put.version, output, err = harness.GetPrometheusVersion(cfg.PrometheusPath)
+	if err != nil {
+		return put, fmt.Errorf("can't determine Prometheus version: %v", err)
+	}
+	log.Printf("Prometheus --version output: %s", output)
+
+	put.promArgs = getExtraArgs(cfg, put.version, put.h.PrometheusOptions())
+	stop, err := put.h.StartPrometheus(ctx, cfg.PrometheusPath, put.promArgs)
 	if err != nil {
-		log.Fatalf("can't construct query URL: %v", err)
+		return put, err
 	}
-	queryUrl := "http://" + instance
+	put.stop = stop
 
-	mainctx := context.Background()
-	h := harness.NewHarness(cfg.TestDirectory, cfg.RmTestDirectory, cfg.ScrapeInterval, cfg.PrombenchListenAddress, instance)
+	if !waitForPrometheus(ctx, put.client, fmt.Sprintf(`up{job="prometheus", instance="%s"}`, put.instance), startTimeout) {
+		return put, fmt.Errorf("Prometheus %s didn't respond within %v", cfg.PrometheusPath, startTimeout)
+	}
 
-	stopPrometheus := h.StartPrometheus(mainctx, cfg.PrometheusPath, getExtraArgs(cfg))
-	defer stopPrometheus()
+	if cfg.ResourceInterval > 0 {
+		put.stopSampling = startResourceSampling(ctx, cfg, put.h, filepath.Join(cfg.TestDirectory, "resources.csv"))
+	}
+	if cfg.StorageInterval > 0 {
+		put.stopStorage = startStorageSampling(ctx, cfg, put.h.StorageDir())
+	}
+	return put, nil
+}
 
-	if !waitForPrometheus(mainctx, instance) {
-		return
+// verifyPrometheus checks what put stored against what was exposed and
+// scraped by it, and reports the resources it used, given the resource and
+// storage samples taken during the run.
+func verifyPrometheus(ctx context.Context, put *promUnderTest, startTime time.Time, expectedSums []loadgen.InstanceSum,
+	scrapes loadgen.ScrapeLedger, resources []ResourceSample, storage map[string]int64) PrometheusResult {
+	cfg, pc := put.cfg, put.client
+	// When two Prometheus servers scrape the same targets, each sees only
+	// some of the values the exporters produce.  Scrape sums are recorded
+	// per Prometheus, but per-series ledgers and counter resets aren't.
+	comparing := cfg.prometheusName != ""
+	resetsDeltaRatio := 0.0
+	if comparing {
+		resetsDeltaRatio = cfg.MaxDeltaRatio
 	}
 
-	le := loadgen.NewLoadExporterInternal(mainctx, h.GetSdCfgDir())
-	exporterCount := startExporters(le, cfg.Exporters, cfg.FirstPort)
-	cancelAdaptive := func() {}
+	var totalDelta, churnSeries, exposedSeries int
+	var diffs []SeriesDiff
+	var checks []QueryCheck
+	// Whole-run totals such as the per-series ledgers no longer match what
+	// should be stored once retention has started discarding samples.
+	withinRetention := time.Since(startTime) <= cfg.TestRetention
+	for _, instsum := range expectedSums {
+		// Queries about a removed target end when it stopped; zero means now.
+		instance, end := instsum.Instance, instsum.Stopped
+		first := len(checks)
+		exposedSeries += instsum.Ledger.Series()
+		query := fmt.Sprintf(`sum(sum_over_time({__name__=~"test.+", instance="%s"}[%%s]))`, instance)
+		check := verifyQueryAt(ctx, cfg, pc, startTime, end, query, windowSum(cfg, scrapes, instance), cfg.MaxDeltaRatio)
+		totalDelta += int(math.Abs(float64(check.Delta)))
+		checks = append(checks, check)
+
+		if instsum.Counter != nil && withinRetention {
+			// increase() extrapolates to the edges of the range, so it's only
+			// held to MaxDeltaRatio, but the number of resets must be exact.
+			query = fmt.Sprintf(`sum(increase({__name__=~"test.+", instance="%s"}[%%s]))`, instance)
+			checks = append(checks, verifyQueryAt(ctx, cfg, pc, startTime, end, query, constant(float64(instsum.Counter.Increase)), cfg.MaxDeltaRatio))
+			query = fmt.Sprintf(`sum(resets({__name__=~"test.+", instance="%s"}[%%s]))`, instance)
+			checks = append(checks, verifyQueryAt(ctx, cfg, pc, startTime, end, query, constant(float64(instsum.Counter.Resets)), resetsDeltaRatio))
+		}
+
+		if instsum.Observations != nil {
+			checks = append(checks, verifyObservations(ctx, cfg, pc, startTime, end, instance, *instsum.Observations)...)
+		}
+
+		if instsum.Series > 0 {
+			checks = append(checks, verifySeries(ctx, cfg, pc, startTime, end, instance, instsum.Series))
+			churnSeries += instsum.Series
+		}
+		for i := first; i < len(checks); i++ {
+			checks[i].Instance = instance
+		}
+
+		if withinRetention && !comparing {
+			diffs = append(diffs, verifyLedger(ctx, cfg, pc, startTime, end, instance, instsum.Ledger)...)
+		}
+	}
+	log.Printf("total delta=%d", totalDelta)
+	if comparing {
+		log.Printf("skipped per-series verification: the exporters are shared with another Prometheus")
+	} else if !withinRetention {
+		log.Printf("skipped per-series verification: run time exceeds retention %s", cfg.TestRetention)
+	} else {
+		diffFile := filepath.Join(cfg.TestDirectory, "series-diff.json")
+		if err := writeSeriesDiffs(diffFile, diffs); err != nil {
+			log.Printf("error writing series diff to %q: %v", diffFile, err)
+		} else {
+			log.Printf("%d series differ from what was exposed, see %q", len(diffs), diffFile)
+		}
+	}
+	if churnSeries > 0 {
+		reportChurn(ctx, pc, startTime, churnSeries)
+	}
+	_, scrapedSamples := scrapes.Window("", time.Time{}, time.Now())
+	reportResources(resources, exposedSeries, scrapedSamples)
+	reportStorage(cfg, storage, scrapedSamples)
+
+	result := PrometheusResult{
+		PrometheusSummary: summarize(ctx, put, startTime, scrapes, resources, storage),
+		Checks:            checks,
+		SeriesDiffs:       len(diffs),
+		Passed:            passed(checks),
+	}
+	result.TotalDelta = totalDelta
+	log.Printf("%d of %d checks passed", countPassed(checks), len(checks))
+	return result
+}
+
+// Run benchmarks Prometheus as described by cfg, returning the outcome, which
+// is also written to result.json in the test directory once that's been set
+// up.  Verification failures aren't errors, but leave result.Passed false.
+// Cancelling ctx stops the load exporters, run-every commands and Prometheus,
+// and Run then returns ctx.Err() without verifying anything.
+func Run(ctx context.Context, cfg Config) (result Result, err error) {
+	if err := cfg.Validate(); err != nil {
+		return result, fmt.Errorf("invalid config: %v", err)
+	}
+	cfg = cfg.phased()
+	result.Start = time.Now()
+
+	var puts []*promUnderTest
+	defer func() {
+		for _, put := range puts {
+			put.stopSamplers()
+			put.stop()
+		}
+	}()
+	var testDirReady bool
+	defer func() {
+		if !testDirReady {
+			return
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		result.End = time.Now()
+		filename := filepath.Join(cfg.TestDirectory, "result.json")
+		if err := writeResult(filename, result); err != nil {
+			log.Printf("error writing result to %q: %v", filename, err)
+		} else {
+			log.Printf("result written to %q, passed=%v", filename, result.Passed)
+		}
+	}()
+	if cfg.ExternalPrometheusURL != "" {
+		put := &promUnderTest{
+			cfg:          cfg,
+			client:       promClient{url: strings.TrimSuffix(cfg.ExternalPrometheusURL, "/"), transport: newQueryTransport(cfg)},
+			stop:         func() {},
+			stopSampling: func() []ResourceSample { return nil },
+			stopStorage:  func() map[string]int64 { return nil },
+		}
+		puts = append(puts, put)
+		if err := harness.SetupTestDir(cfg.TestDirectory, cfg.RmTestDirectory); err != nil {
+			return result, err
+		}
+		testDirReady = true
+		if !waitForPrometheus(ctx, put.client, "vector(1)", startTimeout) {
+			return result, fmt.Errorf("Prometheus at %s didn't respond within %v", put.client.url, startTimeout)
+		}
+	} else {
+		configs := []Config{cfg}
+		if cfg.ComparePrometheusPath != "" {
+			if err := harness.SetupTestDir(cfg.TestDirectory, cfg.RmTestDirectory); err != nil {
+				return result, err
+			}
+			testDirReady = true
+			configs = compareConfigs(cfg)
+		}
+		for _, pcfg := range configs {
+			put, err := startPrometheus(ctx, pcfg)
+			puts = append(puts, put)
+			if put.h != nil {
+				testDirReady = true
+			}
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+	// Adaptive load, crashes and reloads are driven by the first Prometheus.
+	main := puts[0]
+
+	var harnesses []*harness.Harness
+	for _, put := range puts {
+		if put.h != nil {
+			harnesses = append(harnesses, put.h)
+		}
+	}
+	discovery, stopDiscovery, err := newDiscovery(ctx, cfg, harnesses)
+	if err != nil {
+		return result, err
+	}
+	defer stopDiscovery()
+	var le loadgen.LoadExporter
+	if cfg.LoadExporterPath != "" {
+		lee := loadgen.NewLoadExporterExternal(ctx, discovery, cfg.LoadExporterPath, cfg.LoadExporterWorkers)
+		if cfg.TargetHost != "" {
+			lee.SetHost(cfg.TargetHost)
+		}
+		le = lee
+	} else {
+		lei := loadgen.NewLoadExporterInternal(ctx, discovery)
+		if cfg.TargetHost != "" {
+			lei.SetHost(cfg.TargetHost)
+		}
+		if err := lei.SetMultiplex(cfg.Multiplex, cfg.FirstPort); err != nil {
+			return result, fmt.Errorf("error multiplexing targets: %v", err)
+		}
+		le = lei
+	}
+	// Stop the exporters before Prometheus if the run ends early.
+	loadStopped := false
+	defer func() {
+		if !loadStopped {
+			le.Stop()
+		}
+	}()
+	exporterCount, err := startExporters(le, cfg.Exporters, cfg.FirstPort)
+	if err != nil {
+		return result, err
+	}
+	var stopAdaptive func() AdaptiveResult
 	if cfg.AdaptiveInterval > 0 {
-		cancelAdaptive = startExportersAdaptive(mainctx, le, cfg.FirstPort+exporterCount, cfg)
+		stopAdaptive = startAdaptive(ctx, main, le, cfg.FirstPort+exporterCount, exporterCount)
+		defer stopAdaptive()
+	}
+	if cfg.ExternalPrometheusURL != "" {
+		waitForDiscovery(ctx, cfg, le, exporterCount)
 	}
 
-	cancelRunIntervals := startRunIntervals(mainctx, cfg.RunIntervals)
+	cancelRunIntervals := startRunIntervals(ctx, cfg.RunIntervals)
 	defer cancelRunIntervals()
 
 	startTime := time.Now()
-	time.Sleep(cfg.TestDuration)
-	cancelAdaptive()
+	result.Start = startTime
+	var cancelChecks []context.CancelFunc
+	defer func() {
+		for _, cancel := range cancelChecks {
+			cancel()
+		}
+	}()
+	if cfg.CheckInterval > 0 {
+		for _, put := range puts {
+			cancelChecks = append(cancelChecks, startWindowChecks(ctx, le, put.cfg, put.client))
+		}
+	}
+	var stopWorkloads []func() []QueryWorkloadResult
+	defer func() {
+		for _, stop := range stopWorkloads {
+			stop()
+		}
+	}()
+	if len(cfg.Queries) > 0 {
+		for _, put := range puts {
+			stopWorkloads = append(stopWorkloads, startQueryWorkload(ctx, put))
+		}
+	}
+	waitPhases := func() []phaseRecord { return nil }
+	if len(cfg.Phases) > 0 {
+		var cancelPhases context.CancelFunc
+		waitPhases, cancelPhases = startPhases(ctx, main, le, startTime)
+		defer cancelPhases()
+	}
+	stopReloads := func() []reloadRecord { return nil }
+	if len(cfg.Reloads) > 0 {
+		stopReloads = startReloads(ctx, cfg, main.h, main.instance, startTime)
+	}
+	var crash *crashRecovery
+	if cfg.CrashAfter > 0 && sleep(ctx, cfg.CrashAfter) {
+		cr, stop, err := crashPrometheus(ctx, cfg, main.h, main.promArgs, main.client, "vector(1)")
+		if err != nil {
+			stopReloads()
+			return result, err
+		}
+		crash, main.stop = &cr, stop
+	}
+	sleep(ctx, cfg.TestDuration-time.Since(startTime))
+	phases := waitPhases()
+	if stopAdaptive != nil {
+		adaptive := stopAdaptive()
+		reportAdaptive(adaptive)
+		result.Adaptive = &adaptive
+	}
+	for _, cancel := range cancelChecks {
+		cancel()
+	}
+	reloads := stopReloads()
+	// Stop querying before the load does, so verification measures
+	// Prometheus undisturbed.
+	workloads := make([][]QueryWorkloadResult, len(puts))
+	for i, stop := range stopWorkloads {
+		workloads[i] = stop()
+	}
 	expectedSums, err := le.Stop()
-	log.Printf("sums=%v, err=%v", expectedSums, err)
-	var totalDelta int
+	loadStopped = true
+	log.Printf("stopped %d exporters, err=%v", len(expectedSums), err)
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	result.LoadEnd = time.Now()
 	for _, instsum := range expectedSums {
-		expectedSum, instance := instsum.Sum, instsum.Instance
-		var delta int
-		// ttime is used to work out what our expected sum should be, assuming on average each scrape
-		// yields about the same sum, which isn't true for many non-cyclic/constant exporters, e.g. inc.
-		// To make this approach work for them we'll want to allow for an option to use sum(rate) rather
-		// than sum(sum_over_time).
-		ttime := time.Since(startTime)
-		if ttime > cfg.TestRetention {
-			timeRatio := float64(cfg.TestRetention) / float64(ttime)
-			expectedSum = int(timeRatio * float64(expectedSum))
-		}
-		for i := 0; i <= cfg.MaxQueryRetries; i++ {
-			log.Printf("query %s %d (maxretries=%d)", instance, i+1, cfg.MaxQueryRetries)
-			// qtime is how long the query range should be, i.e. it covers from test start to now
-			qtime := time.Since(startTime)
-			ttimestr := fmt.Sprintf("%ds", int(1+qtime.Seconds()))
-			query := fmt.Sprintf(`sum(sum_over_time({__name__=~"test.+", instance="%s"}[%s]))`, instance, ttimestr)
-			queryStart := time.Now()
-			vect := queryPrometheusVector(mainctx, queryUrl, query)
-			QueryTime.WithLabelValues("run1", query).Observe(time.Since(queryStart).Seconds())
-
-			actualSum := -1
-			if len(vect) > 0 {
-				actualSum = int(vect[0].Value)
-			}
-			delta = expectedSum - actualSum
-			deltaRatio := float64(delta) / float64(expectedSum)
-			log.Printf("Expected %d, got %d (delta=%d or %.0f%%)", expectedSum, actualSum, delta, 100*deltaRatio)
-			absRatio := deltaRatio
-			if absRatio < 0 {
-				absRatio = -absRatio
-			}
-			if absRatio <= cfg.MaxDeltaRatio {
-				break
-			}
-			time.Sleep(5 * time.Second)
+		if instsum.Stopped.IsZero() {
+			result.Targets++
 		}
-		if delta < 0 {
-			delta = -delta
+		result.Series += instsum.Ledger.Series()
+	}
+	scrapes := le.Scrapes()
+	// Stop sampling before verification queries add to Prometheus's load.
+	resources := make([][]ResourceSample, len(puts))
+	storage := make([]map[string]int64, len(puts))
+	for i, put := range puts {
+		resources[i], storage[i] = put.stopSamplers()
+	}
+	result.Passed = true
+	if crash != nil {
+		cr := verifyCrash(ctx, cfg, main.client, startTime, *crash, scrapes)
+		result.Crash = &cr
+		result.Passed = cr.Passed
+	}
+	result.Reloads = verifyReloads(ctx, cfg, main.client, reloads, scrapes)
+	for _, rr := range result.Reloads {
+		result.Passed = result.Passed && rr.Passed
+	}
+	if len(phases) > 0 {
+		result.Phases = phaseResults(ctx, main, phases, scrapes.Scraper(main.cfg.prometheusName), resources[0])
+		reportPhases(result.Phases)
+	}
+	summaries := make([]PrometheusSummary, len(puts))
+	for i, put := range puts {
+		pscrapes := scrapes.Scraper(put.cfg.prometheusName)
+		if len(puts) > 1 {
+			log.Printf("verifying Prometheus %s, %s", put.cfg.prometheusName, put.cfg.PrometheusPath)
 		}
-		totalDelta += delta
+		reportDiscovery(put.cfg, discovery, pscrapes)
+		presult := verifyPrometheus(ctx, put, startTime, expectedSums, pscrapes, resources[i], storage[i])
+		presult.QueryWorkload = workloads[i]
+		reportQueryWorkload(workloads[i])
+		result.Prometheus = append(result.Prometheus, presult)
+		result.Passed = result.Passed && presult.Passed
+		summaries[i] = presult.PrometheusSummary
+	}
+	if len(puts) > 1 {
+		reportComparison(cfg, summaries)
+	}
+	if ctx.Err() != nil {
+		result.Passed = false
+		return result, ctx.Err()
+	}
+	return result, nil
+}
+
+// sleep waits for d, returning false if ctx is cancelled first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
 	}
-	log.Printf("total delta=%d", totalDelta)
 }
 
 func startRunIntervals(ctx context.Context, ris RunIntervalSpecList) func() {
@@ -407,13 +1287,12 @@ func startRunInterval(ctx context.Context, ri RunIntervalSpec) func() {
 	myctx, cancel := context.WithCancel(ctx)
 	go func() {
 		ticker := time.NewTicker(ri.Interval)
+		defer ticker.Stop()
 		done := myctx.Done()
 		for {
 			select {
 			case <-done:
-				ticker.Stop()
-				cancel()
-				break
+				return
 			case <-ticker.C:
 				log.Printf("running %s", ri.Command)
 				cmd := exec.CommandContext(myctx, "sh", "-c", ri.Command)
@@ -428,47 +1307,155 @@ func startRunInterval(ctx context.Context, ri RunIntervalSpec) func() {
 	return cancel
 }
 
-func startExporters(le loadgen.LoadExporter, esl ExporterSpecList, firstPort int) int {
+// NewExporter returns a single exporter as described by es, ignoring es.Count.
+func NewExporter(es ExporterSpec) (loadgen.SpecExporter, error) {
+	exporter, err := newExporter(es)
+	if err != nil {
+		return nil, err
+	}
+	es.Count = 1
+	return loadgen.WithSpec(exporter, es.String()), nil
+}
+
+func newExporter(es ExporterSpec) (loadgen.HttpExporter, error) {
+	nmetrics, nlabels := es.GetMetrics(), es.GetLabels()
+	switch es.Exporter {
+	case ExporterInc:
+		return loadgen.NewHttpExporter(loadgen.NewIncCollector(nmetrics, nlabels)), nil
+	case ExporterStatic:
+		return loadgen.NewHttpExporter(loadgen.NewStaticCollector(nmetrics, nlabels)), nil
+	case ExporterRandCyclic:
+		return loadgen.NewHttpExporter(loadgen.NewRandCyclicCollector(nmetrics, nlabels, es.GetMaxValue())), nil
+	case ExporterOscillate:
+		return loadgen.NewReplayHandler(loadgen.NewHttpExporter(loadgen.NewIncCollector(nmetrics, nlabels))), nil
+	case ExporterCounter:
+		return loadgen.NewHttpExporter(loadgen.NewCounterCollector(nmetrics, nlabels, es.ResetEvery)), nil
+	case ExporterHistogram:
+		dist := loadgen.Distributions[es.GetDistribution()]
+		return loadgen.NewHttpExporter(loadgen.NewHistogramCollector(nmetrics, nlabels,
+			es.GetBuckets(), dist, es.GetObservations())), nil
+	case ExporterSummary:
+		dist := loadgen.Distributions[es.GetDistribution()]
+		return loadgen.NewHttpExporter(loadgen.NewSummaryCollector(nmetrics, nlabels,
+			dist, es.GetObservations())), nil
+	case ExporterChurn:
+		return loadgen.NewHttpExporter(loadgen.NewChurnCollector(nmetrics, nlabels,
+			es.GetChurnFraction(), es.GetChurnEvery())), nil
+	}
+	return nil, fmt.Errorf("invalid exporter '%s'", es.Exporter)
+}
+
+// startExporters adds the targets described by esl to le, on consecutive ports
+// from firstPort.  It returns how many were started, which may be fewer than
+// asked for if there was an error.
+func startExporters(le loadgen.LoadExporter, esl ExporterSpecList, firstPort int) (int, error) {
 	log.Printf("starting exporters: %s", esl.String())
 	exporterCount := 0
 	for _, exporterSpec := range esl {
+		shape := []string{exporterSpec.Exporter.Name(),
+			strconv.Itoa(exporterSpec.GetMetrics()), strconv.Itoa(exporterSpec.GetLabels())}
 		for i := 0; i < exporterSpec.Count; i++ {
-			var exporter loadgen.HttpExporter
-			switch exporterSpec.Exporter {
-			case ExporterInc:
-				exporter = loadgen.NewHttpExporter(loadgen.NewIncCollector(100, 100))
-			case ExporterStatic:
-				exporter = loadgen.NewHttpExporter(loadgen.NewStaticCollector(100, 100))
-			case ExporterRandCyclic:
-				exporter = loadgen.NewHttpExporter(loadgen.NewRandCyclicCollector(100, 100, 100000))
-			case ExporterOscillate:
-				exporter = loadgen.NewReplayHandler(loadgen.NewHttpExporter(loadgen.NewIncCollector(100, 100)))
-			default:
-				log.Fatalf("invalid exporter '%s'", exporterSpec.Exporter)
+			exporter, err := NewExporter(exporterSpec)
+			if err != nil {
+				return exporterCount, fmt.Errorf("error creating exporter: %v", err)
 			}
 			if err := le.AddTarget(firstPort+exporterCount, exporterSpec.Exporter.String(), exporter); err != nil {
-				log.Fatalf("Error starting exporter: %v", err)
-			} else {
-				exporterCount++
+				return exporterCount, fmt.Errorf("error starting exporter: %v", err)
 			}
+			exporterCount++
+			ExporterTargets.WithLabelValues(shape...).Inc()
+			ExporterSeries.WithLabelValues(shape...).Add(float64(exporterSpec.GetMetrics() * exporterSpec.GetLabels()))
 		}
 	}
-	return exporterCount
+	return exporterCount, nil
 }
 
-func queryPrometheusVector(ctx context.Context, url, query string) model.Vector {
-	cfg := api.Config{Address: url, Transport: api.DefaultTransport}
-	client, err := api.New(cfg)
+// stopExporters removes the targets started by startExporters with the same
+// esl and firstPort.  It returns how many were removed.
+func stopExporters(le loadgen.LoadExporter, esl ExporterSpecList, firstPort int) (int, error) {
+	exporterCount := 0
+	for _, exporterSpec := range esl {
+		shape := []string{exporterSpec.Exporter.Name(),
+			strconv.Itoa(exporterSpec.GetMetrics()), strconv.Itoa(exporterSpec.GetLabels())}
+		for i := 0; i < exporterSpec.Count; i++ {
+			if err := le.RemoveTarget(firstPort + exporterCount); err != nil {
+				return exporterCount, fmt.Errorf("error stopping exporter: %v", err)
+			}
+			exporterCount++
+			ExporterTargets.WithLabelValues(shape...).Dec()
+			ExporterSeries.WithLabelValues(shape...).Sub(float64(exporterSpec.GetMetrics() * exporterSpec.GetLabels()))
+		}
+	}
+	return exporterCount, nil
+}
+
+// queryPrometheusSeries returns the series matching match that have samples
+// between start and end, using the series metadata API.
+func queryPrometheusSeries(ctx context.Context, pc promClient, match string, start, end time.Time) ([]model.Metric, error) {
+	params := neturl.Values{}
+	params.Set("match[]", match)
+	params.Set("start", strconv.FormatInt(start.Unix(), 10))
+	params.Set("end", strconv.FormatInt(end.Unix()+1, 10))
+	req, err := http.NewRequest("GET", pc.url+"/api/v1/series?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: pc.transport}
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
-		log.Fatalf("error building client: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Status string         `json:"status"`
+		Data   []model.Metric `json:"data"`
+		Error  string         `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error decoding series response: %v", err)
 	}
-	qapi := api.NewQueryAPI(client)
-	// log.Printf("issueing query: %s to %s", query, url)
-	result, err := qapi.Query(ctx, query, time.Now())
+	if result.Status != "success" {
+		return nil, fmt.Errorf("series query failed: %s", result.Error)
+	}
+	return result.Data, nil
+}
+
+func queryPrometheusVector(ctx context.Context, pc promClient, query string) model.Vector {
+	return queryPrometheusVectorAt(ctx, pc, query, time.Now())
+}
+
+// queryPrometheusVectorAt evaluates query at time ts.
+func queryPrometheusVectorAt(ctx context.Context, pc promClient, query string, ts time.Time) model.Vector {
+	qapi, err := pc.queryAPI()
+	if err != nil {
+		log.Printf("error building client: %v", err)
+		return nil
+	}
+	// log.Printf("issueing query: %s to %s", query, pc.url)
+	result, err := qapi.Query(ctx, query, ts)
 	if err != nil {
 		log.Printf("error performing query: %v", err)
 		return nil
 	}
 	// log.Printf("prometheus query result: %v", result)
-	return result.(model.Vector)
+	vect, err := vectorOf(result)
+	if err != nil {
+		log.Printf("error in result of query %s: %v", query, err)
+		return nil
+	}
+	return vect
+}
+
+// vectorOf returns the instant query result v as a vector: a scalar becomes a
+// single element without labels.  Other results are an error.
+func vectorOf(v model.Value) (model.Vector, error) {
+	switch v := v.(type) {
+	case model.Vector:
+		return v, nil
+	case *model.Scalar:
+		return model.Vector{&model.Sample{Metric: model.Metric{}, Value: v.Value, Timestamp: v.Timestamp}}, nil
+	case nil:
+		return nil, fmt.Errorf("no result")
+	}
+	return nil, fmt.Errorf("result is a %s, not a vector or scalar", v.Type())
 }
@@ -0,0 +1,132 @@
+package prombench
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestExporterSpecSet(t *testing.T) {
+	tests := []struct {
+		spec string
+		want ExporterSpec
+	}{
+		{"inc:10", ExporterSpec{Exporter: ExporterInc, Count: 10}},
+		{"static:1:metrics=5,labels=20", ExporterSpec{Exporter: ExporterStatic, Count: 1, Metrics: 5, Labels: 20}},
+		{"randcyclic:2:max=50", ExporterSpec{Exporter: ExporterRandCyclic, Count: 2, MaxValue: 50}},
+		{"counter:3:reset=7", ExporterSpec{Exporter: ExporterCounter, Count: 3, ResetEvery: 7}},
+		{"histogram:1:buckets=0.1;1;10,dist=uniform,obs=3",
+			ExporterSpec{Exporter: ExporterHistogram, Count: 1, Buckets: []float64{0.1, 1, 10}, Distribution: "uniform", Observations: 3}},
+		{"summary:1:dist=normal", ExporterSpec{Exporter: ExporterSummary, Count: 1, Distribution: "normal"}},
+		{"churn:4:fraction=0.5,every=2", ExporterSpec{Exporter: ExporterChurn, Count: 4, ChurnFraction: 0.5, ChurnEvery: 2}},
+	}
+	for _, tt := range tests {
+		var es ExporterSpec
+		if err := es.Set(tt.spec); err != nil {
+			t.Errorf("Set(%q): %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(es, tt.want) {
+			t.Errorf("Set(%q) = %+v, want %+v", tt.spec, es, tt.want)
+		}
+		if got := es.String(); got != tt.spec {
+			t.Errorf("Set(%q).String() = %q", tt.spec, got)
+		}
+	}
+}
+
+func TestExporterSpecSetErrors(t *testing.T) {
+	for _, spec := range []string{
+		"inc",
+		"nosuchkind:1",
+		"inc:0",
+		"inc:x",
+		"inc:1:metrics",
+		"inc:1:metrics=0",
+		"inc:1:bogus=1",
+		"inc:1:max=5",
+		"counter:1:obs=5",
+		"histogram:1:dist=nosuchdist",
+		"histogram:1:buckets=1;x",
+		"churn:1:fraction=1.5",
+	} {
+		var es ExporterSpec
+		if err := es.Set(spec); err == nil {
+			t.Errorf("Set(%q) = %+v, want error", spec, es)
+		}
+	}
+}
+
+func TestExporterSpecListSet(t *testing.T) {
+	tests := []struct {
+		specs string
+		want  ExporterSpecList
+	}{
+		{"inc:1", ExporterSpecList{{Exporter: ExporterInc, Count: 1}}},
+		{"inc:1,static:2:metrics=3,labels=4,counter:5",
+			ExporterSpecList{
+				{Exporter: ExporterInc, Count: 1},
+				{Exporter: ExporterStatic, Count: 2, Metrics: 3, Labels: 4},
+				{Exporter: ExporterCounter, Count: 5},
+			}},
+	}
+	for _, tt := range tests {
+		var esl ExporterSpecList
+		if err := esl.Set(tt.specs); err != nil {
+			t.Errorf("Set(%q): %v", tt.specs, err)
+			continue
+		}
+		if !reflect.DeepEqual(esl, tt.want) {
+			t.Errorf("Set(%q) = %+v, want %+v", tt.specs, esl, tt.want)
+		}
+		if got := esl.String(); got != tt.specs {
+			t.Errorf("Set(%q).String() = %q", tt.specs, got)
+		}
+	}
+}
+
+func TestFlagValues(t *testing.T) {
+	tests := []struct {
+		args []string
+		want [][2]string
+	}{
+		{[]string{"--a", "1", "--b", "2"}, [][2]string{{"a", "1"}, {"b", "2"}}},
+		{[]string{"--a=1", "-b=x"}, [][2]string{{"a", "1"}, {"b", "x"}}},
+		// Boolean flags have no value and don't shift the pairs after them.
+		{[]string{"--web.enable-admin-api", "--a", "1", "--b"}, [][2]string{{"a", "1"}}},
+		{[]string{"--a", "-1", "--b", "-.5"}, [][2]string{{"a", "-1"}, {"b", "-.5"}}},
+		{[]string{"stray", "--a", "1"}, [][2]string{{"a", "1"}}},
+	}
+	for _, tt := range tests {
+		if got := flagValues(tt.args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("flagValues(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestVectorOf(t *testing.T) {
+	vector := model.Vector{{Metric: model.Metric{"a": "b"}, Value: 1, Timestamp: 2}}
+	tests := []struct {
+		v    model.Value
+		want model.Vector
+	}{
+		{vector, vector},
+		{model.Vector{}, model.Vector{}},
+		{&model.Scalar{Value: 3, Timestamp: 4}, model.Vector{{Metric: model.Metric{}, Value: 3, Timestamp: 4}}},
+	}
+	for _, tt := range tests {
+		got, err := vectorOf(tt.v)
+		if err != nil {
+			t.Errorf("vectorOf(%v): %v", tt.v, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("vectorOf(%v) = %v, want %v", tt.v, got, tt.want)
+		}
+	}
+
+	for _, v := range []model.Value{nil, model.Matrix{}, &model.String{Value: "x"}} {
+		if got, err := vectorOf(v); err == nil {
+			t.Errorf("vectorOf(%v) = %v, want error", v, got)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package prombench
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ncabatoff/prombench/harness"
+	"github.com/ncabatoff/prombench/loadgen"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// reloadTimeout is how long to wait for Prometheus to reload and confirm it.
+const reloadTimeout = 30 * time.Second
+
+var (
+	ReloadLatency prometheus.Histogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "prombench",
+			Subsystem: "reload",
+			Name:      "latency_seconds",
+			Help:      "time from asking Prometheus to reload its config until it had",
+		},
+	)
+
+	Reloads *prometheus.CounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prombench",
+			Subsystem: "reload",
+			Name:      "total",
+			Help:      "config reloads requested, by result: success, failure, or unconfirmed",
+		},
+		[]string{"result"},
+	)
+
+	ReloadLostSamples prometheus.Counter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "prombench",
+			Subsystem: "reload",
+			Name:      "lost_samples_total",
+			Help:      "samples scraped around config reloads that weren't stored",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(ReloadLatency)
+	prometheus.MustRegister(Reloads)
+	prometheus.MustRegister(ReloadLostSamples)
+}
+
+type (
+	// ReloadSpec describes a config change and reload to make during the test.
+	ReloadSpec struct {
+		// After is how long into the test to reload.
+		After time.Duration
+		// ScrapeInterval, if nonzero, is the test job's new scrape interval.
+		ScrapeInterval time.Duration
+		// Relabel adds a metric relabel rule to the test job; the rule drops a
+		// metric that doesn't exist, so doesn't change what's stored.
+		Relabel bool
+	}
+	ReloadSpecList []ReloadSpec
+
+	// reloadRecord describes a reload performed during the test.
+	reloadRecord struct {
+		Spec      ReloadSpec
+		Triggered time.Time
+		// Latency is how long Prometheus took to reload, if Confirmed.
+		Latency   time.Duration
+		Confirmed bool
+		// Successful is the value of prometheus_config_last_reload_successful
+		// after the reload.
+		Successful bool
+	}
+
+	// reloadStatus is Prometheus's own account of its last config reload.
+	reloadStatus struct {
+		successful bool
+		timestamp  float64
+	}
+)
+
+func (r *ReloadSpec) String() string {
+	switch {
+	case r.ScrapeInterval > 0:
+		return fmt.Sprintf("%s:scrape-interval=%s", r.After, r.ScrapeInterval)
+	case r.Relabel:
+		return fmt.Sprintf("%s:relabel", r.After)
+	}
+	return r.After.String()
+}
+
+func (r *ReloadSpec) Get() interface{} {
+	return *r
+}
+
+func (r *ReloadSpec) Set(v string) error {
+	pieces := strings.SplitN(v, ":", 2)
+	dur, err := time.ParseDuration(pieces[0])
+	if err != nil {
+		return fmt.Errorf("invalid duration in reload '%s': %v", v, err)
+	}
+	*r = ReloadSpec{After: dur}
+	if len(pieces) == 1 {
+		return nil
+	}
+	change := pieces[1]
+	switch {
+	case change == "relabel":
+		r.Relabel = true
+	case strings.HasPrefix(change, "scrape-interval="):
+		r.ScrapeInterval, err = time.ParseDuration(strings.TrimPrefix(change, "scrape-interval="))
+		if err != nil || r.ScrapeInterval <= 0 {
+			return fmt.Errorf("invalid scrape interval in reload '%s'", v)
+		}
+	default:
+		return fmt.Errorf("bad reload spec '%s': change must be 'relabel' or 'scrape-interval=duration'", v)
+	}
+	return nil
+}
+
+func (rsl *ReloadSpecList) String() string {
+	ss := make([]string, len(*rsl))
+	for i, rs := range *rsl {
+		ss[i] = rs.String()
+	}
+	return strings.Join(ss, ",")
+}
+
+func (rsl *ReloadSpecList) Get() interface{} {
+	return *rsl
+}
+
+func (rsl *ReloadSpecList) Set(v string) error {
+	ss := strings.Split(v, ",")
+	*rsl = make([]ReloadSpec, len(ss))
+	for i, s := range ss {
+		if err := (*rsl)[i].Set(s); err != nil {
+			return fmt.Errorf("error parsing reload spec list '%s', spec '%s' has error: %v", v, s, err)
+		}
+	}
+	return nil
+}
+
+// getReloadStatus reads Prometheus's reload metrics from its /metrics page.
+func getReloadStatus(ctx context.Context, instance string) (reloadStatus, error) {
+	var rs reloadStatus
+	req, err := http.NewRequest("GET", "http://"+instance+"/metrics", nil)
+	if err != nil {
+		return rs, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return rs, err
+	}
+	defer resp.Body.Close()
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return rs, fmt.Errorf("error parsing Prometheus metrics: %v", err)
+	}
+	mf, ok := families["prometheus_config_last_reload_successful"]
+	if !ok || len(mf.Metric) == 0 {
+		return rs, fmt.Errorf("Prometheus doesn't export prometheus_config_last_reload_successful")
+	}
+	rs.successful = mf.Metric[0].GetGauge().GetValue() == 1
+	if mf, ok := families["prometheus_config_last_reload_success_timestamp_seconds"]; ok && len(mf.Metric) > 0 {
+		rs.timestamp = mf.Metric[0].GetGauge().GetValue()
+	}
+	return rs, nil
+}
+
+// reload makes the config change described by rs and reloads Prometheus,
+// waiting up to reloadTimeout for Prometheus to confirm it.  If ctx is
+// cancelled before the change is made, the record returned has a zero
+// Triggered time.
+func reload(ctx context.Context, cfg Config, h *harness.Harness, instance string, rs ReloadSpec, relabels *[]string) reloadRecord {
+	rec := reloadRecord{Spec: rs}
+	myctx, cancel := context.WithTimeout(ctx, reloadTimeout)
+	defer cancel()
+	before, err := getReloadStatus(myctx, instance)
+	if ctx.Err() != nil {
+		return rec
+	}
+	haveBefore := err == nil
+	if !haveBefore {
+		log.Printf("can't get reload status before reloading: %v", err)
+	}
+	if rs.Relabel {
+		*relabels = append(*relabels, fmt.Sprintf("prombench_reload_%d", len(*relabels)))
+	}
+	log.Printf("reloading Prometheus config by %s: %s", cfg.ReloadMethod, rs.String())
+	rec.Triggered = time.Now()
+	err = h.UpdateConfig(myctx, func(params *harness.ConfigParams) {
+		if rs.ScrapeInterval > 0 {
+			params.ScrapeInterval = rs.ScrapeInterval
+		}
+		if len(*relabels) > 0 {
+			params.TestMetricRelabelConfigs = harness.DropMetricsRelabelConfig(*relabels)
+		}
+	})
+	if err != nil {
+		log.Printf("error reloading Prometheus config: %v", err)
+		Reloads.WithLabelValues("failure").Inc()
+		return rec
+	}
+	if cfg.ReloadMethod == harness.ReloadHTTP {
+		// The reload endpoint only returns once the reload is done.
+		rec.Latency, rec.Confirmed = time.Since(rec.Triggered), true
+	} else if !haveBefore {
+		// Without the status from before there's no change to look for.
+		log.Printf("can't confirm Prometheus reloaded its config without its reload status from before")
+		Reloads.WithLabelValues("unconfirmed").Inc()
+		return rec
+	}
+
+	// Prometheus only notes the time of successful reloads, to the second, so
+	// a SIGHUP reload is confirmed by a change of timestamp or of success.
+	for {
+		after, err := getReloadStatus(myctx, instance)
+		if err == nil && (rec.Confirmed || after != before) {
+			if !rec.Confirmed {
+				rec.Latency, rec.Confirmed = time.Since(rec.Triggered), true
+			}
+			rec.Successful = after.successful
+			break
+		}
+		if !sleep(myctx, 100*time.Millisecond) {
+			if ctx.Err() != nil {
+				log.Printf("stopped waiting for Prometheus to confirm reloading its config")
+			} else {
+				log.Printf("Prometheus didn't confirm reloading its config within %v", reloadTimeout)
+				Reloads.WithLabelValues("unconfirmed").Inc()
+			}
+			return rec
+		}
+	}
+
+	ReloadLatency.Observe(rec.Latency.Seconds())
+	if rec.Successful {
+		Reloads.WithLabelValues("success").Inc()
+		log.Printf("Prometheus reloaded its config in %v", rec.Latency)
+	} else {
+		Reloads.WithLabelValues("failure").Inc()
+		log.Printf("Prometheus failed to reload its config, prometheus_config_last_reload_successful is 0")
+	}
+	return rec
+}
+
+// startReloads performs the reloads in cfg.Reloads, timed from startTime, in
+// the background.  The function returned cancels any not yet performed, and
+// returns the records of those that were.
+func startReloads(ctx context.Context, cfg Config, h *harness.Harness, instance string, startTime time.Time) func() []reloadRecord {
+	specs := append(ReloadSpecList(nil), cfg.Reloads...)
+	sort.SliceStable(specs, func(i, j int) bool { return specs[i].After < specs[j].After })
+
+	myctx, cancel := context.WithCancel(ctx)
+	var mtx sync.Mutex
+	var records []reloadRecord
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var relabels []string
+		for _, rs := range specs {
+			timer := time.NewTimer(time.Until(startTime.Add(rs.After)))
+			select {
+			case <-myctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			rec := reload(myctx, cfg, h, instance, rs, &relabels)
+			if rec.Triggered.IsZero() {
+				return
+			}
+			mtx.Lock()
+			records = append(records, rec)
+			mtx.Unlock()
+		}
+	}()
+	return func() []reloadRecord {
+		cancel()
+		<-done
+		mtx.Lock()
+		defer mtx.Unlock()
+		return records
+	}
+}
+
+// verifyReloads reports how many samples scraped around each reload weren't
+// stored, and how long targets went unscraped.
+func verifyReloads(ctx context.Context, cfg Config, pc promClient, records []reloadRecord, scrapes loadgen.ScrapeLedger) []ReloadResult {
+	// Look at a few of the longest scrape intervals either side of each reload.
+	interval := cfg.ScrapeInterval
+	for _, rec := range records {
+		if rec.Spec.ScrapeInterval > interval {
+			interval = rec.Spec.ScrapeInterval
+		}
+	}
+	window := 3 * interval
+	query := `sum(count_over_time({__name__=~"test.+"}[%s]))`
+	var results []ReloadResult
+	for _, rec := range records {
+		check := verifyQueryAt(ctx, cfg, pc, rec.Triggered.Add(-window), rec.Triggered.Add(window), query,
+			windowSamples(cfg, scrapes, ""), cfg.MaxDeltaRatio)
+		lost := math.Abs(float64(check.Delta))
+		ReloadLostSamples.Add(lost)
+		gap := scrapeGap(scrapes, rec.Triggered)
+		log.Printf("reload %s: %s samples lost within %v of the reload, targets went unscraped for up to %v",
+			rec.Spec.String(), formatValue(lost), window, gap)
+		results = append(results, ReloadResult{
+			Spec:           rec.Spec.String(),
+			Confirmed:      rec.Confirmed,
+			Successful:     rec.Successful,
+			LatencySeconds: rec.Latency.Seconds(),
+			LostSamples:    lost,
+			GapSeconds:     gap.Seconds(),
+			Check:          check,
+			Passed:         check.Passed && rec.Successful,
+		})
+	}
+	return results
+}
@@ -0,0 +1,201 @@
+package prombench
+
+import (
+	"context"
+	"encoding/csv"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ncabatoff/prombench/harness"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/procfs"
+)
+
+var (
+	PrometheusRSS        = newProcessGauge("resident_memory_bytes", "resident memory of the Prometheus process")
+	PrometheusCPU        = newProcessGauge("cpu_seconds", "user and system CPU time used by the Prometheus process since it started")
+	PrometheusOpenFDs    = newProcessGauge("open_fds", "open file descriptors of the Prometheus process")
+	PrometheusThreads    = newProcessGauge("threads", "threads of the Prometheus process")
+	PrometheusReadBytes  = newProcessGauge("read_bytes", "bytes read from storage by the Prometheus process since it started")
+	PrometheusWriteBytes = newProcessGauge("write_bytes", "bytes written to storage by the Prometheus process since it started")
+)
+
+// newProcessGauge returns a gauge of the process of each Prometheus, labelled
+// by the name it's given when comparing two.
+func newProcessGauge(name, help string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "prombench",
+		Subsystem: "prometheus_process",
+		Name:      name,
+		Help:      help + ", read from /proc by prombench",
+	}, []string{"prometheus"})
+}
+
+func init() {
+	prometheus.MustRegister(PrometheusRSS)
+	prometheus.MustRegister(PrometheusCPU)
+	prometheus.MustRegister(PrometheusOpenFDs)
+	prometheus.MustRegister(PrometheusThreads)
+	prometheus.MustRegister(PrometheusReadBytes)
+	prometheus.MustRegister(PrometheusWriteBytes)
+}
+
+// ResourceSample is the resource usage of the Prometheus process at a moment.
+// CPU and I/O are cumulative since the process started.
+type ResourceSample struct {
+	Time       time.Time
+	PID        int
+	RSSBytes   int
+	CPUSeconds float64
+	OpenFDs    int
+	Threads    int
+	ReadBytes  uint64
+	WriteBytes uint64
+}
+
+var resourceHeader = []string{"time", "pid", "rss_bytes", "cpu_seconds", "open_fds", "threads", "read_bytes", "write_bytes"}
+
+func (rs ResourceSample) record() []string {
+	return []string{
+		rs.Time.UTC().Format(time.RFC3339Nano),
+		strconv.Itoa(rs.PID),
+		strconv.Itoa(rs.RSSBytes),
+		formatValue(rs.CPUSeconds),
+		strconv.Itoa(rs.OpenFDs),
+		strconv.Itoa(rs.Threads),
+		strconv.FormatUint(rs.ReadBytes, 10),
+		strconv.FormatUint(rs.WriteBytes, 10),
+	}
+}
+
+// sampleResources reads the resource usage of process pid from /proc.
+func sampleResources(pid int) (ResourceSample, error) {
+	rs := ResourceSample{Time: time.Now(), PID: pid}
+	proc, err := procfs.NewProc(pid)
+	if err != nil {
+		return rs, err
+	}
+	stat, err := proc.NewStat()
+	if err != nil {
+		return rs, err
+	}
+	rs.RSSBytes = stat.ResidentMemory()
+	rs.CPUSeconds = stat.CPUTime()
+	rs.Threads = stat.NumThreads
+	if rs.OpenFDs, err = proc.FileDescriptorsLen(); err != nil {
+		return rs, err
+	}
+	// /proc/<pid>/io is only readable by the process's owner or root.
+	if pio, err := proc.NewIO(); err == nil {
+		rs.ReadBytes = pio.ReadBytes
+		rs.WriteBytes = pio.WriteBytes
+	}
+	return rs, nil
+}
+
+// startResourceSampling samples the resource usage of the Prometheus run by h
+// every cfg.ResourceInterval, exposing it as metrics and appending it to
+// filename as CSV.  The function returned stops sampling and returns the
+// samples taken.
+func startResourceSampling(ctx context.Context, cfg Config, h *harness.Harness, filename string) func() []ResourceSample {
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Printf("not sampling Prometheus resource usage: %v", err)
+		return func() []ResourceSample { return nil }
+	}
+	w := csv.NewWriter(f)
+	w.Write(resourceHeader)
+
+	myctx, cancel := context.WithCancel(ctx)
+	var mtx sync.Mutex
+	var samples []ResourceSample
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(cfg.ResourceInterval)
+		defer ticker.Stop()
+		for {
+			// Look up the PID each time, since Prometheus may be restarted.
+			if pid := h.PrometheusPID(); pid != 0 {
+				rs, err := sampleResources(pid)
+				if err != nil {
+					log.Printf("error sampling Prometheus resource usage: %v", err)
+				} else {
+					name := cfg.prometheusName
+					PrometheusRSS.WithLabelValues(name).Set(float64(rs.RSSBytes))
+					PrometheusCPU.WithLabelValues(name).Set(rs.CPUSeconds)
+					PrometheusOpenFDs.WithLabelValues(name).Set(float64(rs.OpenFDs))
+					PrometheusThreads.WithLabelValues(name).Set(float64(rs.Threads))
+					PrometheusReadBytes.WithLabelValues(name).Set(float64(rs.ReadBytes))
+					PrometheusWriteBytes.WithLabelValues(name).Set(float64(rs.WriteBytes))
+					w.Write(rs.record())
+					w.Flush()
+					mtx.Lock()
+					samples = append(samples, rs)
+					mtx.Unlock()
+				}
+			}
+			select {
+			case <-myctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() []ResourceSample {
+		cancel()
+		<-done
+		if err := w.Error(); err != nil {
+			log.Printf("error writing %q: %v", filename, err)
+		}
+		f.Close()
+		mtx.Lock()
+		defer mtx.Unlock()
+		return samples
+	}
+}
+
+// cpuUsed returns the CPU seconds used over samples, allowing for restarts of
+// the process, which reset its CPU time.
+func cpuUsed(samples []ResourceSample) float64 {
+	var used float64
+	for i := 1; i < len(samples); i++ {
+		prev, cur := samples[i-1], samples[i]
+		if cur.PID == prev.PID {
+			used += cur.CPUSeconds - prev.CPUSeconds
+		} else {
+			used += cur.CPUSeconds
+		}
+	}
+	return used
+}
+
+// maxRSS returns the largest resident memory in samples.
+func maxRSS(samples []ResourceSample) int {
+	var max int
+	for _, rs := range samples {
+		if rs.RSSBytes > max {
+			max = rs.RSSBytes
+		}
+	}
+	return max
+}
+
+// reportResources logs the memory used per series and CPU used per sample,
+// given the number of distinct series exposed and samples scraped.
+func reportResources(samples []ResourceSample, series, scraped int) {
+	if len(samples) == 0 {
+		return
+	}
+	rss, cpu := maxRSS(samples), cpuUsed(samples)
+	log.Printf("Prometheus used at most %d bytes RSS and %.2f CPU seconds over the run", rss, cpu)
+	if series > 0 {
+		log.Printf("%.0f bytes RSS per series over %d series", float64(rss)/float64(series), series)
+	}
+	if scraped > 0 {
+		log.Printf("%.2f CPU microseconds per sample over %d samples", 1e6*cpu/float64(scraped), scraped)
+	}
+}
@@ -0,0 +1,43 @@
+package prombench
+
+import "testing"
+
+func TestCPUUsedAndMaxRSS(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []ResourceSample
+		cpu     float64
+		rss     int
+	}{
+		{"none", nil, 0, 0},
+		// CPU used before the first sample isn't counted.
+		{"one", []ResourceSample{{PID: 1, CPUSeconds: 5, RSSBytes: 100}}, 0, 100},
+		{"steady", []ResourceSample{
+			{PID: 1, CPUSeconds: 1, RSSBytes: 100},
+			{PID: 1, CPUSeconds: 1.5, RSSBytes: 300},
+			{PID: 1, CPUSeconds: 4, RSSBytes: 200},
+		}, 3, 300},
+		// A new PID is a restarted Prometheus, whose CPU time starts over
+		// from zero.
+		{"restart", []ResourceSample{
+			{PID: 1, CPUSeconds: 1, RSSBytes: 100},
+			{PID: 1, CPUSeconds: 3, RSSBytes: 400},
+			{PID: 2, CPUSeconds: 0.5, RSSBytes: 50},
+			{PID: 2, CPUSeconds: 2.25, RSSBytes: 150},
+		}, 4.25, 400},
+		{"two restarts", []ResourceSample{
+			{PID: 1, CPUSeconds: 10, RSSBytes: 100},
+			{PID: 2, CPUSeconds: 1, RSSBytes: 200},
+			{PID: 3, CPUSeconds: 2, RSSBytes: 300},
+			{PID: 3, CPUSeconds: 2.5, RSSBytes: 100},
+		}, 3.5, 300},
+	}
+	for _, tt := range tests {
+		if got := cpuUsed(tt.samples); got != tt.cpu {
+			t.Errorf("%s: cpuUsed() = %v, want %v", tt.name, got, tt.cpu)
+		}
+		if got := maxRSS(tt.samples); got != tt.rss {
+			t.Errorf("%s: maxRSS() = %d, want %d", tt.name, got, tt.rss)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package prombench
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"time"
+)
+
+type (
+	// Result is the outcome of a Run, which is also written to result.json
+	// in the test directory.
+	Result struct {
+		// Passed is whether every Prometheus passed all its query checks,
+		// the samples scraped before a crash survived it, and every reload
+		// passed.
+		Passed bool `json:"passed"`
+		// Error, if set, is why the run stopped before verification.
+		Error string `json:"error,omitempty"`
+		// Start is when the load started, LoadEnd when the exporters were
+		// stopped, and End when verification finished.
+		Start   time.Time `json:"start"`
+		LoadEnd time.Time `json:"load_end"`
+		End     time.Time `json:"end"`
+		// Targets and Series are the load level reached: how many load
+		// targets were running at the end, and the distinct series they
+		// exposed over the run.
+		Targets    int                `json:"targets"`
+		Series     int                `json:"series"`
+		Prometheus []PrometheusResult `json:"prometheus"`
+		Crash      *CrashResult       `json:"crash,omitempty"`
+		Reloads    []ReloadResult     `json:"reloads,omitempty"`
+		Adaptive   *AdaptiveResult    `json:"adaptive,omitempty"`
+		// Phases break down the run by scenario phase, for the first
+		// Prometheus.
+		Phases []PhaseResult `json:"phases,omitempty"`
+	}
+
+	// PrometheusResult is the outcome of verifying one Prometheus.
+	PrometheusResult struct {
+		PrometheusSummary
+		Checks []QueryCheck `json:"checks"`
+		// SeriesDiffs is how many series in series-diff.json differ from
+		// what was exposed.
+		SeriesDiffs int `json:"series_diffs"`
+		// QueryWorkload is how each query of the workload issued while the
+		// load ran fared.
+		QueryWorkload []QueryWorkloadResult `json:"query_workload,omitempty"`
+		Passed        bool                  `json:"passed"`
+	}
+
+	// QueryCheck is the outcome of comparing a query's result with what was
+	// expected, as of the last attempt.  For a check of histogram buckets,
+	// Expected is the number of buckets and Actual the number that were
+	// within MaxDeltaRatio of their expected counts.
+	QueryCheck struct {
+		Instance      string `json:"instance,omitempty"`
+		Query         string `json:"query"`
+		Expected      Value  `json:"expected"`
+		Actual        Value  `json:"actual"`
+		Delta         Value  `json:"delta"`
+		DeltaRatio    Value  `json:"delta_ratio"`
+		MaxDeltaRatio Value  `json:"max_delta_ratio"`
+		// Retries is how many times the query was retried.
+		Retries        int     `json:"retries"`
+		LatencySeconds float64 `json:"latency_seconds"`
+		Passed         bool    `json:"passed"`
+	}
+
+	// CrashResult measures what a crash of Prometheus cost.
+	CrashResult struct {
+		// RecoverySeconds is how long Prometheus took to answer queries
+		// after being restarted, or zero if it didn't.
+		RecoverySeconds float64 `json:"recovery_seconds"`
+		LostSamples     float64 `json:"lost_samples"`
+		GapSeconds      float64 `json:"gap_seconds"`
+		// Checks compare the samples stored up to the kill with those
+		// scraped, within MaxDeltaRatio; Passed is whether both passed.
+		Checks []QueryCheck `json:"checks"`
+		Passed bool         `json:"passed"`
+	}
+
+	// ReloadResult measures what a config reload cost.
+	ReloadResult struct {
+		Spec           string  `json:"spec"`
+		Confirmed      bool    `json:"confirmed"`
+		Successful     bool    `json:"successful"`
+		LatencySeconds float64 `json:"latency_seconds"`
+		LostSamples    float64 `json:"lost_samples"`
+		GapSeconds     float64 `json:"gap_seconds"`
+		// Check compares the samples stored around the reload with those
+		// scraped, within MaxDeltaRatio.  Passed is whether it passed and
+		// Prometheus confirmed reloading successfully.
+		Check  QueryCheck `json:"check"`
+		Passed bool       `json:"passed"`
+	}
+
+	// Value is a float64 that's marshalled to JSON as a number if it's
+	// finite, and otherwise as a string such as "NaN" or "+Inf", since query
+	// results and expectations needn't be finite.
+	Value float64
+)
+
+func (v Value) MarshalJSON() ([]byte, error) {
+	f := float64(v)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return json.Marshal(formatValue(f))
+	}
+	return json.Marshal(f)
+}
+
+// passed returns whether all checks passed.
+func passed(checks []QueryCheck) bool {
+	return countPassed(checks) == len(checks)
+}
+
+// countPassed returns how many of checks passed.
+func countPassed(checks []QueryCheck) int {
+	var n int
+	for _, check := range checks {
+		if check.Passed {
+			n++
+		}
+	}
+	return n
+}
+
+// writeResult writes r as JSON to filename.
+func writeResult(filename string, r Result) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0600)
+}
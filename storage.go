@@ -0,0 +1,173 @@
+package prombench
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Kinds of storage distinguished by storageKind.
+const (
+	StorageWAL        = "wal"
+	StorageHeadChunks = "head_chunks"
+	StorageBlocks     = "blocks"
+	StorageChunks1x   = "chunks_1x"
+	StorageOther      = "other"
+)
+
+var (
+	StorageBytes *prometheus.GaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prombench",
+			Subsystem: "storage",
+			Name:      "bytes",
+			Help:      "size of the files in the Prometheus data directory, by kind: wal, head_chunks, blocks, chunks_1x or other",
+		},
+		[]string{"prometheus", "kind"},
+	)
+
+	StorageBytesPerSample *prometheus.GaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prombench",
+			Subsystem: "storage",
+			Name:      "bytes_per_sample",
+			Help:      "size of the Prometheus data directory at the end of the run divided by the number of samples scraped",
+		},
+		[]string{"prometheus"},
+	)
+
+	// blockDirRegexp matches the ULID names of 2.x TSDB block directories.
+	blockDirRegexp = regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{26}$`)
+	// chunkDirRegexp matches the fingerprint prefix directories of 1.x chunk files.
+	chunkDirRegexp = regexp.MustCompile(`^[0-9a-f]{2}$`)
+)
+
+func init() {
+	prometheus.MustRegister(StorageBytes)
+	prometheus.MustRegister(StorageBytesPerSample)
+}
+
+// storageKind returns the kind of storage the file at rel, relative to the
+// data directory, belongs to.
+func storageKind(rel string) string {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	switch {
+	case parts[0] == "wal":
+		return StorageWAL
+	case parts[0] == "chunks_head":
+		return StorageHeadChunks
+	case len(parts) > 1 && blockDirRegexp.MatchString(parts[0]):
+		return StorageBlocks
+	case len(parts) > 1 && chunkDirRegexp.MatchString(parts[0]):
+		return StorageChunks1x
+	}
+	return StorageOther
+}
+
+// measureStorage returns the total size of the files under dir by kind.
+func measureStorage(dir string) (map[string]int64, error) {
+	sizes := map[string]int64{
+		StorageWAL:        0,
+		StorageHeadChunks: 0,
+		StorageBlocks:     0,
+		StorageChunks1x:   0,
+		StorageOther:      0,
+	}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Compaction and truncation remove files while we walk.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		sizes[storageKind(rel)] += info.Size()
+		return nil
+	})
+	return sizes, err
+}
+
+// totalStorage returns the sum of sizes.
+func totalStorage(sizes map[string]int64) int64 {
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	return total
+}
+
+// startStorageSampling measures the Prometheus data directory dir every
+// cfg.StorageInterval, exposing the sizes as StorageBytes.  The function
+// returned stops sampling and returns the sizes measured then.
+func startStorageSampling(ctx context.Context, cfg Config, dir string) func() map[string]int64 {
+	measure := func() map[string]int64 {
+		sizes, err := measureStorage(dir)
+		if err != nil {
+			log.Printf("error measuring storage in %q: %v", dir, err)
+		}
+		for kind, size := range sizes {
+			StorageBytes.WithLabelValues(cfg.prometheusName, kind).Set(float64(size))
+		}
+		return sizes
+	}
+
+	myctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(cfg.StorageInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-myctx.Done():
+				return
+			case <-ticker.C:
+				measure()
+			}
+		}
+	}()
+	return func() map[string]int64 {
+		cancel()
+		<-done
+		return measure()
+	}
+}
+
+// reportStorage logs the storage used by kind and per sample scraped.
+func reportStorage(cfg Config, sizes map[string]int64, scraped int) {
+	if sizes == nil {
+		return
+	}
+	kinds := make([]string, 0, len(sizes))
+	for kind := range sizes {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	var parts []string
+	for _, kind := range kinds {
+		if sizes[kind] > 0 {
+			parts = append(parts, kind+"="+formatValue(float64(sizes[kind])))
+		}
+	}
+	total := totalStorage(sizes)
+	log.Printf("Prometheus storage is %d bytes: %s", total, strings.Join(parts, " "))
+	if scraped > 0 {
+		bps := float64(total) / float64(scraped)
+		StorageBytesPerSample.WithLabelValues(cfg.prometheusName).Set(bps)
+		log.Printf("%.2f bytes of storage per sample over %d samples", bps, scraped)
+	}
+}
@@ -0,0 +1,38 @@
+package prombench
+
+import "testing"
+
+func TestStorageKind(t *testing.T) {
+	tests := []struct {
+		rel  string
+		want string
+	}{
+		{"wal/00000002", StorageWAL},
+		{"wal/checkpoint.00000001/00000000", StorageWAL},
+		{"chunks_head/000001", StorageHeadChunks},
+		{"01BKGV7JBM69T2G1BGBGM6KB12/chunks/000001", StorageBlocks},
+		{"01BKGV7JBM69T2G1BGBGM6KB12/index", StorageBlocks},
+		{"01BKGV7JBM69T2G1BGBGM6KB12/meta.json", StorageBlocks},
+		{"0a/0a1b2c3d4e5f6a7b.db", StorageChunks1x},
+		{"ff/ff00000000000000.db", StorageChunks1x},
+		// Files directly in the data directory aren't blocks or chunks, even
+		// if their names look like it.
+		{"01BKGV7JBM69T2G1BGBGM6KB12", StorageOther},
+		{"0a", StorageOther},
+		{"lock", StorageOther},
+		{"queries.active", StorageOther},
+		{"heads.db", StorageOther},
+		// ULIDs don't use I, L, O or U, and are upper case; chunk
+		// directories are lower case hex.
+		{"01BKGV7JBM69T2G1BGBGM6KB1U/index", StorageOther},
+		{"01bkgv7jbm69t2g1bgbgm6kb12/index", StorageOther},
+		{"0A/0a1b2c3d4e5f6a7b.db", StorageOther},
+		{"0ab/0a1b2c3d4e5f6a7b.db", StorageOther},
+		{"archived_fingerprint_to_metric/000001.ldb", StorageOther},
+	}
+	for _, tt := range tests {
+		if got := storageKind(tt.rel); got != tt.want {
+			t.Errorf("storageKind(%q) = %q, want %q", tt.rel, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,516 @@
+package prombench
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ncabatoff/prombench/loadgen"
+	"github.com/prometheus/common/model"
+	"io/ioutil"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Kinds of SeriesDiff.
+const (
+	DiffMissingSamples = "missing_samples"
+	DiffExtraSamples   = "extra_samples"
+	DiffWrongValue     = "wrong_value"
+)
+
+// SeriesDiff describes a series whose stored samples don't match what was exposed.
+// A series that wasn't stored at all has ActualSamples zero, and one that was
+// stored but never exposed has ExpectedSamples zero.
+type SeriesDiff struct {
+	Instance        string  `json:"instance"`
+	Series          string  `json:"series"`
+	Kind            string  `json:"kind"`
+	ExpectedSamples int     `json:"expected_samples"`
+	ActualSamples   int     `json:"actual_samples"`
+	ExpectedSum     float64 `json:"expected_sum"`
+	ActualSum       float64 `json:"actual_sum"`
+}
+
+// verifyQuantiles are the quantiles checked with histogram_quantile.
+var verifyQuantiles = []float64{0.5, 0.9, 0.99}
+
+// expectation returns the expected result of a query whose range covers the
+// half-open interval (start, end].
+type expectation func(start, end time.Time) float64
+
+// constant returns an expectation that doesn't depend on the query range.
+func constant(v float64) expectation {
+	return func(start, end time.Time) float64 { return v }
+}
+
+// windowSum returns an expectation of the sum of the values scraped from
+// instance during the query range, as recorded in scrapes, excluding any
+// scrapes old enough to have been discarded by retention by now.
+func windowSum(cfg Config, scrapes loadgen.ScrapeLedger, instance string) expectation {
+	return func(start, end time.Time) float64 {
+		if cutoff := time.Now().Add(-cfg.TestRetention); cfg.TestRetention > 0 && cutoff.After(start) {
+			start = cutoff
+		}
+		sum, _ := scrapes.Window(instance, start, end)
+		return float64(sum)
+	}
+}
+
+// formatRange formats d as a PromQL range duration.
+func formatRange(d time.Duration) string {
+	return fmt.Sprintf("%dms", int64(d/time.Millisecond))
+}
+
+// rangeQuery formats queryfmt, which must contain a %s placeholder for a range,
+// with a range covering from startTime to end.  It returns the query along with
+// the start of the range; the query should be evaluated at end.
+func rangeQuery(queryfmt string, startTime, end time.Time) (query string, start time.Time) {
+	// qtime is how long the query range should be, i.e. it covers from test start to now
+	qtime := time.Duration(1+end.Sub(startTime).Seconds()) * time.Second
+	return fmt.Sprintf(queryfmt, formatRange(qtime)), end.Add(-qtime)
+}
+
+// deltaRatio returns delta relative to expected, treating any nonzero delta
+// from an expected value of zero as 100%.
+func deltaRatio(delta, expected float64) float64 {
+	if expected != 0 {
+		return delta / expected
+	} else if delta != 0 {
+		return 1
+	}
+	return 0
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// verifyQueryAt runs query, which must contain a %s placeholder for a range
+// covering the test from startTime to endTime, or to now if endTime is zero,
+// until its result is within maxDeltaRatio of what expect gives for that range
+// or cfg.MaxQueryRetries is exhausted.  It returns the outcome of the last
+// attempt.
+func verifyQueryAt(ctx context.Context, cfg Config, pc promClient, startTime, endTime time.Time, queryfmt string, expect expectation, maxDeltaRatio float64) QueryCheck {
+	var check QueryCheck
+	for i := 0; i <= cfg.MaxQueryRetries; i++ {
+		end := endTime
+		if end.IsZero() {
+			end = time.Now()
+		}
+		query, start := rangeQuery(queryfmt, startTime, end)
+		expected := expect(start, end)
+		log.Printf("query %s %d (maxretries=%d)", query, i+1, cfg.MaxQueryRetries)
+		queryStart := time.Now()
+		vect := queryPrometheusVectorAt(ctx, pc, query, end)
+		latency := time.Since(queryStart)
+		QueryTime.WithLabelValues(cfg.runName(), query).Observe(latency.Seconds())
+
+		actual := -1.0
+		if len(vect) > 0 {
+			actual = float64(vect[0].Value)
+		}
+		delta := expected - actual
+		ratio := deltaRatio(delta, expected)
+		log.Printf("Expected %s, got %s (delta=%s or %.0f%%)", formatValue(expected),
+			formatValue(actual), formatValue(delta), 100*ratio)
+		check = QueryCheck{
+			Query:          query,
+			Expected:       Value(expected),
+			Actual:         Value(actual),
+			Delta:          Value(delta),
+			DeltaRatio:     Value(ratio),
+			MaxDeltaRatio:  Value(maxDeltaRatio),
+			Retries:        i,
+			LatencySeconds: latency.Seconds(),
+			Passed:         math.Abs(ratio) <= maxDeltaRatio,
+		}
+		if check.Passed || !sleep(ctx, 5*time.Second) {
+			break
+		}
+	}
+	return check
+}
+
+// verifyBuckets runs query, which must contain a %s placeholder for a range
+// and return one element per histogram bucket labelled by le, until every
+// bucket is within maxDeltaRatio of expected or cfg.MaxQueryRetries is
+// exhausted.  The range ends at endTime, or now if that's zero.  The check
+// returned counts buckets rather than observations.
+func verifyBuckets(ctx context.Context, cfg Config, pc promClient, startTime, endTime time.Time, queryfmt string, expected map[float64]float64, maxDeltaRatio float64) QueryCheck {
+	var check QueryCheck
+	for i := 0; i <= cfg.MaxQueryRetries; i++ {
+		end := endTime
+		if end.IsZero() {
+			end = time.Now()
+		}
+		query, _ := rangeQuery(queryfmt, startTime, end)
+		log.Printf("query %s %d (maxretries=%d)", query, i+1, cfg.MaxQueryRetries)
+		queryStart := time.Now()
+		vect := queryPrometheusVectorAt(ctx, pc, query, end)
+		latency := time.Since(queryStart)
+		QueryTime.WithLabelValues(cfg.runName(), query).Observe(latency.Seconds())
+
+		actuals := make(map[float64]float64, len(vect))
+		for _, sample := range vect {
+			le, err := strconv.ParseFloat(string(sample.Metric[model.BucketLabel]), 64)
+			if err != nil {
+				log.Printf("invalid bucket label in %v: %v", sample.Metric, err)
+				continue
+			}
+			actuals[le] = float64(sample.Value)
+		}
+
+		var bad int
+		for le, exp := range expected {
+			actual, ok := actuals[le]
+			if !ok {
+				actual = -1
+			}
+			delta := exp - actual
+			ratio := deltaRatio(delta, exp)
+			if math.Abs(ratio) > maxDeltaRatio {
+				bad++
+				log.Printf("bucket le=%s: expected %s, got %s (delta=%s or %.0f%%)", formatValue(le),
+					formatValue(exp), formatValue(actual), formatValue(delta), 100*ratio)
+			}
+		}
+		log.Printf("%d of %d buckets outside tolerance", bad, len(expected))
+		check = QueryCheck{
+			Query:          query,
+			Expected:       Value(len(expected)),
+			Actual:         Value(len(expected) - bad),
+			Delta:          Value(bad),
+			DeltaRatio:     Value(deltaRatio(float64(bad), float64(len(expected)))),
+			MaxDeltaRatio:  Value(maxDeltaRatio),
+			Retries:        i,
+			LatencySeconds: latency.Seconds(),
+			Passed:         bad == 0,
+		}
+		if check.Passed || !sleep(ctx, 5*time.Second) {
+			break
+		}
+	}
+	return check
+}
+
+// verifyObservations checks the stored count, sum and, for histograms, bucket
+// totals and quantiles of the histograms or summaries exposed by instance up
+// to endTime, or now if that's zero.  Since bucket, count and sum series are
+// cumulative, max_over_time yields their final values.
+func verifyObservations(ctx context.Context, cfg Config, pc promClient, startTime, endTime time.Time, instance string, obs loadgen.ObservationSum) []QueryCheck {
+	query := fmt.Sprintf(`sum(max_over_time({__name__=~"test.+_count", instance="%s"}[%%s]))`, instance)
+	checks := []QueryCheck{verifyQueryAt(ctx, cfg, pc, startTime, endTime, query, constant(float64(obs.Count)), cfg.MaxDeltaRatio)}
+	query = fmt.Sprintf(`sum(max_over_time({__name__=~"test.+_sum", instance="%s"}[%%s]))`, instance)
+	checks = append(checks, verifyQueryAt(ctx, cfg, pc, startTime, endTime, query, constant(obs.Sum), cfg.MaxDeltaRatio))
+	if len(obs.Buckets) == 0 {
+		return checks
+	}
+
+	expected := make(map[float64]float64, len(obs.Buckets)+1)
+	for _, b := range obs.Buckets {
+		expected[b.UpperBound] = float64(b.Count)
+	}
+	expected[math.Inf(1)] = float64(obs.Count)
+	buckets := fmt.Sprintf(`sum by (le) (max_over_time({__name__=~"test.+_bucket", instance="%s"}[%%s]))`, instance)
+	checks = append(checks, verifyBuckets(ctx, cfg, pc, startTime, endTime, buckets, expected, cfg.MaxDeltaRatio))
+
+	for _, q := range verifyQuantiles {
+		query = fmt.Sprintf(`histogram_quantile(%g, %s)`, q, buckets)
+		checks = append(checks, verifyQueryAt(ctx, cfg, pc, startTime, endTime, query, constant(bucketQuantile(q, expected)), cfg.MaxDeltaRatio))
+	}
+	return checks
+}
+
+// bucketQuantile estimates quantile q from cumulative bucket counts keyed by
+// upper bound, including +Inf, the same way Prometheus's histogram_quantile does.
+func bucketQuantile(q float64, buckets map[float64]float64) float64 {
+	if q < 0 {
+		return math.Inf(-1)
+	}
+	if q > 1 {
+		return math.Inf(1)
+	}
+	bounds := make([]float64, 0, len(buckets))
+	for le := range buckets {
+		bounds = append(bounds, le)
+	}
+	sort.Float64s(bounds)
+	if len(bounds) < 2 || !math.IsInf(bounds[len(bounds)-1], 1) {
+		return math.NaN()
+	}
+	counts := make([]float64, len(bounds))
+	for i, le := range bounds {
+		counts[i] = buckets[le]
+	}
+	observations := counts[len(counts)-1]
+	if observations == 0 {
+		return math.NaN()
+	}
+
+	rank := q * observations
+	b := sort.Search(len(counts)-1, func(i int) bool { return counts[i] >= rank })
+	if b == len(counts)-1 {
+		return bounds[len(bounds)-2]
+	}
+	if b == 0 && bounds[0] <= 0 {
+		return bounds[0]
+	}
+	var (
+		bucketStart float64
+		bucketEnd   = bounds[b]
+		count       = counts[b]
+	)
+	if b > 0 {
+		bucketStart = bounds[b-1]
+		count -= counts[b-1]
+		rank -= counts[b-1]
+	}
+	return bucketStart + (bucketEnd-bucketStart)*(rank/count)
+}
+
+// verifySeries checks that the number of distinct series Prometheus has stored
+// for instance between startTime and endTime, or now if that's zero, is within
+// MaxDeltaRatio of expected.
+func verifySeries(ctx context.Context, cfg Config, pc promClient, startTime, endTime time.Time, instance string, expected int) QueryCheck {
+	match := fmt.Sprintf(`{__name__=~"test.+", instance="%s"}`, instance)
+	var check QueryCheck
+	for i := 0; i <= cfg.MaxQueryRetries; i++ {
+		log.Printf("series %s %d (maxretries=%d)", match, i+1, cfg.MaxQueryRetries)
+		queryStart := time.Now()
+		end := endTime
+		if end.IsZero() {
+			end = queryStart
+		}
+		series, err := queryPrometheusSeries(ctx, pc, match, startTime, end)
+		latency := time.Since(queryStart)
+		QueryTime.WithLabelValues(cfg.runName(), "series "+match).Observe(latency.Seconds())
+		actual := -1
+		if err != nil {
+			log.Printf("error performing series query: %v", err)
+		} else {
+			actual = len(series)
+		}
+		delta := expected - actual
+		ratio := deltaRatio(float64(delta), float64(expected))
+		log.Printf("Expected %d series, got %d (delta=%d or %.0f%%)", expected, actual, delta, 100*ratio)
+		check = QueryCheck{
+			Query:          "series " + match,
+			Expected:       Value(expected),
+			Actual:         Value(actual),
+			Delta:          Value(delta),
+			DeltaRatio:     Value(ratio),
+			MaxDeltaRatio:  Value(cfg.MaxDeltaRatio),
+			Retries:        i,
+			LatencySeconds: latency.Seconds(),
+			Passed:         math.Abs(ratio) <= cfg.MaxDeltaRatio,
+		}
+		if check.Passed || !sleep(ctx, 5*time.Second) {
+			break
+		}
+	}
+	return check
+}
+
+// reportChurn logs how many series Prometheus created in its head during the
+// run compared with the distinct series exposed by churn exporters, along with
+// Prometheus's memory use per created series as a rough measure of churn cost.
+// The TSDB metrics used only exist in Prometheus 2.0 and later.
+func reportChurn(ctx context.Context, pc promClient, startTime time.Time, churnSeries int) {
+	end := time.Now()
+	query, _ := rangeQuery(`sum(increase(prometheus_tsdb_head_series_created_total{job="prometheus"}[%s]))`, startTime, end)
+	vect := queryPrometheusVectorAt(ctx, pc, query, end)
+	if len(vect) == 0 {
+		log.Printf("churn: %d distinct series exposed by churn exporters; head series created not available", churnSeries)
+		return
+	}
+	created := float64(vect[0].Value)
+	log.Printf("churn: %d distinct series exposed by churn exporters, %.0f head series created during run (all jobs)",
+		churnSeries, created)
+
+	vect = queryPrometheusVector(ctx, pc, `process_resident_memory_bytes{job="prometheus"}`)
+	if len(vect) > 0 && created > 0 {
+		log.Printf("churn: %.0f bytes resident per head series created", float64(vect[0].Value)/created)
+	}
+}
+
+// queryLedger returns the per-series totals Prometheus has stored between
+// startTime and endTime, or now if that's zero, for metric name scraped from
+// instance.
+func queryLedger(ctx context.Context, cfg Config, pc promClient, startTime, endTime time.Time, instance, name string) (map[string]loadgen.SeriesTotal, error) {
+	totals := make(map[string]loadgen.SeriesTotal)
+	selector := fmt.Sprintf(`{__name__=%q, instance=%q}`, name, instance)
+	for _, fn := range []string{"count_over_time", "sum_over_time"} {
+		end := endTime
+		if end.IsZero() {
+			end = time.Now()
+		}
+		query, _ := rangeQuery(fmt.Sprintf("%s(%s[%%s])", fn, selector), startTime, end)
+		queryStart := time.Now()
+		vect := queryPrometheusVectorAt(ctx, pc, query, end)
+		QueryTime.WithLabelValues(cfg.runName(), query).Observe(time.Since(queryStart).Seconds())
+		if vect == nil {
+			return nil, fmt.Errorf("query %s failed", query)
+		}
+		for _, sample := range vect {
+			ls := model.LabelSet(sample.Metric.Clone())
+			delete(ls, model.MetricNameLabel)
+			delete(ls, model.InstanceLabel)
+			delete(ls, model.JobLabel)
+			key := ls.String()
+			st := totals[key]
+			if fn == "count_over_time" {
+				st.Samples = int(sample.Value)
+			} else {
+				st.Sum = float64(sample.Value)
+			}
+			totals[key] = st
+		}
+	}
+	return totals, nil
+}
+
+// diffSeries compares the expected and actual totals for the series of metric name.
+func diffSeries(instance, name string, expected, actual map[string]loadgen.SeriesTotal) []SeriesDiff {
+	var diffs []SeriesDiff
+	for labels, exp := range expected {
+		act := actual[labels]
+		diff := SeriesDiff{
+			Instance:        instance,
+			Series:          name + labels,
+			ExpectedSamples: exp.Samples,
+			ActualSamples:   act.Samples,
+			ExpectedSum:     exp.Sum,
+			ActualSum:       act.Sum,
+		}
+		switch {
+		case act.Samples < exp.Samples:
+			diff.Kind = DiffMissingSamples
+		case act.Samples > exp.Samples:
+			diff.Kind = DiffExtraSamples
+		case math.Abs(act.Sum-exp.Sum) > 1e-9*math.Max(1, math.Abs(exp.Sum)):
+			diff.Kind = DiffWrongValue
+		default:
+			continue
+		}
+		diffs = append(diffs, diff)
+	}
+	for labels, act := range actual {
+		if _, ok := expected[labels]; !ok {
+			diffs = append(diffs, SeriesDiff{
+				Instance:      instance,
+				Series:        name + labels,
+				Kind:          DiffExtraSamples,
+				ActualSamples: act.Samples,
+				ActualSum:     act.Sum,
+			})
+		}
+	}
+	return diffs
+}
+
+// verifyLedger compares every series in ledger with what Prometheus has stored
+// for instance up to endTime, or now if that's zero, one metric name at a
+// time, retrying each up to cfg.MaxQueryRetries times while differences
+// remain.  It returns the remaining differences.
+func verifyLedger(ctx context.Context, cfg Config, pc promClient, startTime, endTime time.Time, instance string, ledger loadgen.SeriesLedger) []SeriesDiff {
+	names := make([]string, 0, len(ledger))
+	for name := range ledger {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var diffs []SeriesDiff
+	for _, name := range names {
+		var nameDiffs []SeriesDiff
+		for i := 0; i <= cfg.MaxQueryRetries; i++ {
+			actual, err := queryLedger(ctx, cfg, pc, startTime, endTime, instance, name)
+			if err != nil {
+				log.Printf("error querying series of %s for %s: %v", name, instance, err)
+				actual = nil
+			}
+			nameDiffs = diffSeries(instance, name, ledger[name], actual)
+			if len(nameDiffs) == 0 || !sleep(ctx, 5*time.Second) {
+				break
+			}
+		}
+		diffs = append(diffs, nameDiffs...)
+	}
+	log.Printf("%s: %d of %d series differ from what was exposed", instance, len(diffs), ledger.Series())
+	return diffs
+}
+
+// writeSeriesDiffs writes diffs as JSON to filename.
+func writeSeriesDiffs(filename string, diffs []SeriesDiff) error {
+	if diffs == nil {
+		diffs = []SeriesDiff{}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Instance != diffs[j].Instance {
+			return diffs[i].Instance < diffs[j].Instance
+		}
+		return diffs[i].Series < diffs[j].Series
+	})
+	data, err := json.MarshalIndent(diffs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0600)
+}
+
+// startWindowChecks periodically verifies, while the test is running, that the
+// sum of the values stored for each load instance during the last
+// cfg.CheckInterval matches what the scrape ledger of le says was served to
+// it.  The window checked ends a scrape interval in the past, to give
+// Prometheus time to ingest the most recent scrapes.
+func startWindowChecks(ctx context.Context, le loadgen.LoadExporter, cfg Config, pc promClient) context.CancelFunc {
+	myctx, cancel := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(cfg.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-myctx.Done():
+				return
+			case <-ticker.C:
+				checkWindow(myctx, le.Scrapes().Scraper(cfg.prometheusName), cfg, pc)
+			}
+		}
+	}()
+	return cancel
+}
+
+func checkWindow(ctx context.Context, scrapes loadgen.ScrapeLedger, cfg Config, pc promClient) {
+	end := time.Now().Add(-cfg.ScrapeInterval)
+	start := end.Add(-cfg.CheckInterval)
+	var bad int
+	instances := scrapes.Instances()
+	var checked int
+	for _, instance := range instances {
+		expected, samples := scrapes.Window(instance, start, end)
+		// Nothing was served to it in the window, so it was added or
+		// removed around it; there's nothing to check.
+		if samples == 0 {
+			continue
+		}
+		checked++
+		query := fmt.Sprintf(`sum(sum_over_time({__name__=~"test.+", instance="%s"}[%s]))`, instance, formatRange(cfg.CheckInterval))
+		queryStart := time.Now()
+		vect := queryPrometheusVectorAt(ctx, pc, query, end)
+		QueryTime.WithLabelValues(cfg.runName(), query).Observe(time.Since(queryStart).Seconds())
+		actual := -1.0
+		if len(vect) > 0 {
+			actual = float64(vect[0].Value)
+		}
+		delta := float64(expected) - actual
+		ratio := deltaRatio(delta, float64(expected))
+		if math.Abs(ratio) > cfg.MaxDeltaRatio {
+			bad++
+			log.Printf("window check %s: expected %d, got %s (delta=%s or %.0f%%)", instance, expected,
+				formatValue(actual), formatValue(delta), 100*ratio)
+		}
+	}
+	log.Printf("window check ending %s: %d of %d instances outside tolerance", end.Format(time.RFC3339), bad, checked)
+}
@@ -0,0 +1,80 @@
+package prombench
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/ncabatoff/prombench/loadgen"
+)
+
+func TestBucketQuantile(t *testing.T) {
+	inf := math.Inf(1)
+	buckets := map[float64]float64{1: 10, 2: 20, inf: 20}
+	tests := []struct {
+		q       float64
+		buckets map[float64]float64
+		want    float64
+	}{
+		{-0.1, buckets, math.Inf(-1)},
+		{1.1, buckets, inf},
+		{0.25, buckets, 0.5},
+		{0.5, buckets, 1},
+		{0.75, buckets, 1.5},
+		{1, buckets, 2},
+		// Ranks in the +Inf bucket return the highest finite bound.
+		{0.9, map[float64]float64{1: 10, inf: 20}, 1},
+		// The first bucket starts at zero unless its bound is below it.
+		{0.2, map[float64]float64{-1: 5, 1: 10, inf: 10}, -1},
+		{0.5, map[float64]float64{1: 10, 2: 20}, math.NaN()},
+		{0.5, map[float64]float64{inf: 10}, math.NaN()},
+		{0.5, map[float64]float64{1: 0, inf: 0}, math.NaN()},
+	}
+	for _, tt := range tests {
+		got := bucketQuantile(tt.q, tt.buckets)
+		if got != tt.want && !(math.IsNaN(got) && math.IsNaN(tt.want)) {
+			t.Errorf("bucketQuantile(%g, %v) = %g, want %g", tt.q, tt.buckets, got, tt.want)
+		}
+	}
+}
+
+func TestDiffSeries(t *testing.T) {
+	expected := map[string]loadgen.SeriesTotal{
+		`{a="1"}`: {Samples: 3, Sum: 6},
+		`{a="2"}`: {Samples: 3, Sum: 6},
+		`{a="3"}`: {Samples: 3, Sum: 6},
+		`{a="4"}`: {Samples: 3, Sum: 6},
+		`{a="5"}`: {Samples: 3, Sum: 6},
+	}
+	actual := map[string]loadgen.SeriesTotal{
+		`{a="1"}`: {Samples: 3, Sum: 6},
+		`{a="2"}`: {Samples: 2, Sum: 4},
+		`{a="3"}`: {Samples: 4, Sum: 8},
+		`{a="4"}`: {Samples: 3, Sum: 7},
+		`{a="6"}`: {Samples: 1, Sum: 1},
+	}
+	want := []SeriesDiff{
+		{Instance: "i", Series: `m{a="2"}`, Kind: DiffMissingSamples, ExpectedSamples: 3, ActualSamples: 2, ExpectedSum: 6, ActualSum: 4},
+		{Instance: "i", Series: `m{a="3"}`, Kind: DiffExtraSamples, ExpectedSamples: 3, ActualSamples: 4, ExpectedSum: 6, ActualSum: 8},
+		{Instance: "i", Series: `m{a="4"}`, Kind: DiffWrongValue, ExpectedSamples: 3, ActualSamples: 3, ExpectedSum: 6, ActualSum: 7},
+		{Instance: "i", Series: `m{a="5"}`, Kind: DiffMissingSamples, ExpectedSamples: 3, ExpectedSum: 6},
+		{Instance: "i", Series: `m{a="6"}`, Kind: DiffExtraSamples, ActualSamples: 1, ActualSum: 1},
+	}
+	got := diffSeries("i", "m", expected, actual)
+	sort.Slice(got, func(i, j int) bool { return got[i].Series < got[j].Series })
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffSeries() = %+v, want %+v", got, want)
+	}
+
+	if diffs := diffSeries("i", "m", expected, expected); len(diffs) != 0 {
+		t.Errorf("diffSeries() of identical totals = %+v, want none", diffs)
+	}
+	// Sums are compared with a relative tolerance for float rounding.
+	a, b := 0.1, 0.2
+	if diffs := diffSeries("i", "m",
+		map[string]loadgen.SeriesTotal{"{}": {Samples: 1, Sum: 0.3}},
+		map[string]loadgen.SeriesTotal{"{}": {Samples: 1, Sum: a + b}}); len(diffs) != 0 {
+		t.Errorf("diffSeries() with rounding error = %+v, want none", diffs)
+	}
+}
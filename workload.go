@@ -0,0 +1,271 @@
+package prombench
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/prometheus/client_golang/api/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	WorkloadQueryTime *prometheus.HistogramVec = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "prombench",
+			Subsystem: "query_workload",
+			Name:      "latency_seconds",
+			Help:      "time to execute workload queries, by query name",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+		},
+		[]string{"run_name", "query"},
+	)
+
+	WorkloadQueryErrors *prometheus.CounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prombench",
+			Subsystem: "query_workload",
+			Name:      "errors_total",
+			Help:      "number of workload queries that failed, by query name",
+		},
+		[]string{"run_name", "query"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(WorkloadQueryTime)
+	prometheus.MustRegister(WorkloadQueryErrors)
+}
+
+type (
+	// QuerySpec is a query the query workload issues.  If Range is zero it's
+	// an instant query, otherwise a range query over the Range to now with
+	// resolution Step.
+	QuerySpec struct {
+		Name  string
+		Query string
+		Range time.Duration
+		Step  time.Duration
+	}
+	QuerySpecList []QuerySpec
+
+	// QueryWorkloadResult is how one query of the workload fared.
+	QueryWorkloadResult struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+		// RangeSeconds and StepSeconds are zero for an instant query.
+		RangeSeconds float64 `json:"range_seconds"`
+		StepSeconds  float64 `json:"step_seconds"`
+		Queries      int     `json:"queries"`
+		Errors       int     `json:"errors"`
+		ErrorRate    float64 `json:"error_rate"`
+		// Latencies are of the queries that succeeded.
+		LatencyP50 float64 `json:"latency_p50_seconds"`
+		LatencyP90 float64 `json:"latency_p90_seconds"`
+		LatencyP99 float64 `json:"latency_p99_seconds"`
+		LatencyMax float64 `json:"latency_max_seconds"`
+	}
+
+	// queryStats accumulates the outcomes of one query of the workload.
+	queryStats struct {
+		latencies []time.Duration
+		errors    int
+	}
+)
+
+// defaultQueryPoints is how many points range queries not given a step are
+// resolved to, as Grafana does.
+const defaultQueryPoints = 250
+
+// maxQueryRate is the highest QueryRate allowed, beyond which the interval
+// between queries would round down to nothing.
+const maxQueryRate = 1e6
+
+func (qs *QuerySpec) String() string {
+	if qs.Range == 0 {
+		return fmt.Sprintf("%s:0:%s", qs.Name, qs.Query)
+	}
+	return fmt.Sprintf("%s:%s/%s:%s", qs.Name, qs.Range, qs.Step, qs.Query)
+}
+
+func (qs *QuerySpec) Get() interface{} {
+	return *qs
+}
+
+// Set parses a query given as name:range[/step]:query, where a range of 0
+// means an instant query.
+func (qs *QuerySpec) Set(v string) error {
+	pieces := strings.SplitN(v, ":", 3)
+	if len(pieces) != 3 || pieces[0] == "" || strings.TrimSpace(pieces[2]) == "" {
+		return fmt.Errorf("bad query spec '%s': must be name:range[/step]:query", v)
+	}
+	*qs = QuerySpec{Name: pieces[0], Query: pieces[2]}
+	rangeStep := strings.SplitN(pieces[1], "/", 2)
+	var err error
+	if qs.Range, err = time.ParseDuration(rangeStep[0]); err != nil || qs.Range < 0 {
+		return fmt.Errorf("invalid range in query spec '%s'", v)
+	}
+	if len(rangeStep) == 2 {
+		if qs.Step, err = time.ParseDuration(rangeStep[1]); err != nil || qs.Step <= 0 || qs.Range == 0 {
+			return fmt.Errorf("invalid step in query spec '%s'", v)
+		}
+	} else if qs.Range > 0 {
+		qs.Step = qs.Range / defaultQueryPoints
+		if qs.Step < time.Second {
+			qs.Step = time.Second
+		}
+	}
+	return nil
+}
+
+func (qsl *QuerySpecList) String() string {
+	ss := make([]string, len(*qsl))
+	for i, qs := range *qsl {
+		ss[i] = qs.String()
+	}
+	return strings.Join(ss, " ")
+}
+
+func (qsl *QuerySpecList) Get() interface{} {
+	return *qsl
+}
+
+// Set adds a query to the list.  Queries may contain commas, so unlike other
+// lists each query is given separately.
+func (qsl *QuerySpecList) Set(v string) error {
+	var qs QuerySpec
+	if err := qs.Set(v); err != nil {
+		return err
+	}
+	*qsl = append(*qsl, qs)
+	return nil
+}
+
+// startQueryWorkload issues the queries of put's config against it in the
+// background, cycling through them from QueryConcurrency workers, at no more
+// than QueryRate queries per second overall if that's nonzero.  The function
+// returned stops the workload and returns how each query fared.
+func startQueryWorkload(ctx context.Context, put *promUnderTest) func() []QueryWorkloadResult {
+	cfg := put.cfg
+	specs := cfg.Queries
+	stats := make([]queryStats, len(specs))
+	var mtx sync.Mutex
+
+	qapi, err := put.client.queryAPI()
+	if err != nil {
+		log.Printf("error building client for the query workload: %v", err)
+		return func() []QueryWorkloadResult { return nil }
+	}
+
+	myctx, cancel := context.WithCancel(ctx)
+	// Each value sent on next is the index of a query to issue.
+	next := make(chan int)
+	go func() {
+		defer close(next)
+		var tick <-chan time.Time
+		if cfg.QueryRate > 0 {
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.QueryRate))
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for i := 0; ; i = (i + 1) % len(specs) {
+			if tick != nil {
+				select {
+				case <-myctx.Done():
+					return
+				case <-tick:
+				}
+			}
+			select {
+			case <-myctx.Done():
+				return
+			case next <- i:
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < cfg.QueryConcurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				qs := specs[i]
+				start := time.Now()
+				var err error
+				if qs.Range == 0 {
+					_, err = qapi.Query(myctx, qs.Query, start)
+				} else {
+					_, err = qapi.QueryRange(myctx, qs.Query, api.Range{Start: start.Add(-qs.Range), End: start, Step: qs.Step})
+				}
+				latency := time.Since(start)
+				if myctx.Err() != nil {
+					// Queries cut short by the end of the workload don't count.
+					return
+				}
+				mtx.Lock()
+				if err != nil {
+					stats[i].errors++
+				} else {
+					stats[i].latencies = append(stats[i].latencies, latency)
+				}
+				mtx.Unlock()
+				if err != nil {
+					WorkloadQueryErrors.WithLabelValues(cfg.runName(), qs.Name).Inc()
+				} else {
+					WorkloadQueryTime.WithLabelValues(cfg.runName(), qs.Name).Observe(latency.Seconds())
+				}
+			}
+		}()
+	}
+
+	return func() []QueryWorkloadResult {
+		cancel()
+		wg.Wait()
+		mtx.Lock()
+		defer mtx.Unlock()
+		results := make([]QueryWorkloadResult, len(specs))
+		for i, qs := range specs {
+			results[i] = stats[i].result(qs)
+		}
+		return results
+	}
+}
+
+// result summarizes st as the outcome of qs.
+func (st queryStats) result(qs QuerySpec) QueryWorkloadResult {
+	r := QueryWorkloadResult{
+		Name:         qs.Name,
+		Query:        qs.Query,
+		RangeSeconds: qs.Range.Seconds(),
+		StepSeconds:  qs.Step.Seconds(),
+		Errors:       st.errors,
+		Queries:      st.errors + len(st.latencies),
+	}
+	if r.Queries > 0 {
+		r.ErrorRate = float64(r.Errors) / float64(r.Queries)
+	}
+	if len(st.latencies) == 0 {
+		return r
+	}
+	latencies := append([]time.Duration(nil), st.latencies...)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) float64 {
+		return latencies[int(p*float64(len(latencies)-1))].Seconds()
+	}
+	r.LatencyP50, r.LatencyP90, r.LatencyP99 = percentile(0.5), percentile(0.9), percentile(0.99)
+	r.LatencyMax = latencies[len(latencies)-1].Seconds()
+	return r
+}
+
+// reportQueryWorkload logs how each query of the workload fared.
+func reportQueryWorkload(results []QueryWorkloadResult) {
+	for _, r := range results {
+		log.Printf("query workload %s: %d queries, %.2f%% errors, latency p50 %.3fs p90 %.3fs p99 %.3fs max %.3fs",
+			r.Name, r.Queries, 100*r.ErrorRate, r.LatencyP50, r.LatencyP90, r.LatencyP99, r.LatencyMax)
+	}
+}
@@ -0,0 +1,108 @@
+package prombench
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQuerySpecSet(t *testing.T) {
+	tests := []struct {
+		spec string
+		want QuerySpec
+	}{
+		{"up:0:up", QuerySpec{Name: "up", Query: "up"}},
+		// Range queries without a step get one giving defaultQueryPoints
+		// points, but at least a second.
+		{"rate:1h:rate(x[5m])", QuerySpec{Name: "rate", Query: "rate(x[5m])", Range: time.Hour, Step: 14400 * time.Millisecond}},
+		{"short:1m:x", QuerySpec{Name: "short", Query: "x", Range: time.Minute, Step: time.Second}},
+		{"sum:10m/30s:sum(x)", QuerySpec{Name: "sum", Query: "sum(x)", Range: 10 * time.Minute, Step: 30 * time.Second}},
+		// Only the first two colons separate fields.
+		{`sel:0:x{a="b:c"}`, QuerySpec{Name: "sel", Query: `x{a="b:c"}`}},
+	}
+	for _, tt := range tests {
+		var qs QuerySpec
+		if err := qs.Set(tt.spec); err != nil {
+			t.Errorf("Set(%q): %v", tt.spec, err)
+			continue
+		}
+		if qs != tt.want {
+			t.Errorf("Set(%q) = %+v, want %+v", tt.spec, qs, tt.want)
+		}
+		var again QuerySpec
+		if err := again.Set(qs.String()); err != nil || again != qs {
+			t.Errorf("Set(%q) of String() of %+v = %+v, %v", qs.String(), qs, again, err)
+		}
+	}
+
+	for _, spec := range []string{
+		"up",
+		":0:up",
+		"up:0: ",
+		"up:soon:up",
+		"up:-1m:up",
+		"up:0/5s:up",
+		"up:1m/0s:up",
+		"up:1m/x:up",
+	} {
+		var qs QuerySpec
+		if err := qs.Set(spec); err == nil {
+			t.Errorf("Set(%q) = %+v, want error", spec, qs)
+		}
+	}
+}
+
+func TestQuerySpecListSet(t *testing.T) {
+	var qsl QuerySpecList
+	for _, spec := range []string{"a:0:sum(x, y)", "b:1m/5s:y"} {
+		if err := qsl.Set(spec); err != nil {
+			t.Fatalf("Set(%q): %v", spec, err)
+		}
+	}
+	want := QuerySpecList{
+		{Name: "a", Query: "sum(x, y)"},
+		{Name: "b", Query: "y", Range: time.Minute, Step: 5 * time.Second},
+	}
+	if !reflect.DeepEqual(qsl, want) {
+		t.Errorf("QuerySpecList = %+v, want %+v", qsl, want)
+	}
+}
+
+func TestQueryStatsResult(t *testing.T) {
+	qs := QuerySpec{Name: "r", Query: "x", Range: time.Minute, Step: 2 * time.Second}
+	var st queryStats
+	// Latencies arrive in any order.
+	for i := 100; i > 0; i-- {
+		st.latencies = append(st.latencies, time.Duration(i)*time.Millisecond)
+	}
+	st.errors = 25
+	want := QueryWorkloadResult{
+		Name:         "r",
+		Query:        "x",
+		RangeSeconds: 60,
+		StepSeconds:  2,
+		Queries:      125,
+		Errors:       25,
+		ErrorRate:    0.2,
+		LatencyP50:   0.05,
+		LatencyP90:   0.09,
+		LatencyP99:   0.099,
+		LatencyMax:   0.1,
+	}
+	if got := st.result(qs); got != want {
+		t.Errorf("result() = %+v, want %+v", got, want)
+	}
+	if st.latencies[0] != 100*time.Millisecond {
+		t.Errorf("result() reordered the latencies it was given")
+	}
+
+	empty := QueryWorkloadResult{Name: "r", Query: "x", RangeSeconds: 60, StepSeconds: 2}
+	if got := (queryStats{}).result(qs); got != empty {
+		t.Errorf("result() of no queries = %+v, want %+v", got, empty)
+	}
+	failed := empty
+	failed.Queries, failed.Errors, failed.ErrorRate = 3, 3, 1
+	if got := (queryStats{errors: 3}).result(qs); got != failed {
+		t.Errorf("result() of failed queries = %+v, want %+v", got, failed)
+	}
+}